@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/benthosdev/benthos/v4/public/service"
+)
+
+// isArrayType reports whether a udt_name is an array or vector type, which the
+// table query reads with array_to_json.
+func isArrayType(udtName string) bool {
+	return strings.HasPrefix(udtName, "_") || strings.HasSuffix(udtName, "vector")
+}
+
+func init() {
+	spec := service.NewConfigSpec().
+		Summary("Parses the JSON text of array columns into JSON arrays.").
+		Field(service.NewStringListField("columns")).
+		Field(service.NewBoolField("repeated").Default(false))
+	err := service.RegisterProcessor("leftshove_arrays", spec, func(conf *service.ParsedConfig, mgr *service.Resources) (service.Processor, error) {
+		var p arraysProcessor
+		var err error
+		if p.columns, err = conf.FieldStringList("columns"); err != nil {
+			return nil, err
+		}
+		if p.repeated, err = conf.FieldBool("repeated"); err != nil {
+			return nil, err
+		}
+		return &p, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+type arraysProcessor struct {
+	columns  []string
+	repeated bool
+}
+
+// Process replaces the array columns' JSON text with the arrays. For REPEATED
+// BigQuery fields, which can't hold nested arrays or NULLs, multi-dimensional
+// arrays are flattened in row-major order and NULL elements are dropped.
+func (p *arraysProcessor) Process(ctx context.Context, msg *service.Message) (service.MessageBatch, error) {
+	structured, err := msg.AsStructuredMut()
+	if err != nil {
+		return nil, fmt.Errorf("arrays message read error: %v", err)
+	}
+	row, ok := structured.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("arrays message is not an object: %T", structured)
+	}
+	for _, column := range p.columns {
+		s, ok := row[column].(string)
+		if !ok {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+		dec.UseNumber()
+		var array []any
+		err = dec.Decode(&array)
+		if err != nil {
+			return nil, fmt.Errorf("array column %v parse error: %v", column, err)
+		}
+		if p.repeated {
+			array = flattenArray(array, []any{})
+		}
+		row[column] = array
+	}
+	msg.SetStructuredMut(row)
+	return service.MessageBatch{msg}, nil
+}
+
+func (p *arraysProcessor) Close(ctx context.Context) error {
+	return nil
+}
+
+// flattenArray appends the non NULL elements of array and its nested arrays to flat.
+func flattenArray(array []any, flat []any) []any {
+	for _, e := range array {
+		switch e := e.(type) {
+		case nil:
+		case []any:
+			flat = flattenArray(e, flat)
+		default:
+			flat = append(flat, e)
+		}
+	}
+	return flat
+}
+
+// newArraysProcessor returns the processor parsing t's array columns, or an
+// empty string if it has none. BigQuery tables created before arrays were
+// mapped to REPEATED fields keep receiving them as JSON text.
+func newArraysProcessor(t table, outputType string) (string, error) {
+	tableSchema, err := sinkTableSchema(t)
+	if err != nil {
+		return "", err
+	}
+	columns, err := parseSchemaColumns(tableSchema)
+	if err != nil {
+		return "", err
+	}
+	var bqSchema bigquery.Schema
+	if outputType == "BQ" {
+		if t.BQSchema != "" {
+			bqSchema, err = bigquery.SchemaFromJSON([]byte(t.BQSchema))
+		} else {
+			_, bqSchema, err = tableBQSchema(t)
+		}
+		if err != nil {
+			return "", fmt.Errorf("bq schema error: %v", err)
+		}
+	}
+	var arrays []string
+	for _, c := range columns {
+		if !isArrayType(c.UDTName) {
+			continue
+		}
+		if outputType == "BQ" && !bqRepeated(bqSchema, c.Name) {
+			continue
+		}
+		arrays = append(arrays, c.Name)
+	}
+	if len(arrays) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(arrays)
+	if err != nil {
+		return "", fmt.Errorf("array columns marshal error: %v", err)
+	}
+	processorYAML := `leftshove_arrays:
+  columns: {columns}
+  repeated: {repeated}`
+	return strings.NewReplacer(
+		"{columns}", string(b),
+		"{repeated}", fmt.Sprint(outputType == "BQ"),
+	).Replace(processorYAML), nil
+}
+
+func bqRepeated(schema bigquery.Schema, name string) bool {
+	for _, field := range schema {
+		if field.Name == name {
+			return field.Repeated
+		}
+	}
+	return false
+}
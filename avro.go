@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/linkedin/goavro/v2"
+	"github.com/spf13/cast"
+)
+
+// avroColumn is a row column and the Avro field it is encoded as.
+type avroColumn struct {
+	column  string
+	name    string
+	avro    string
+	logical string
+	schema  any
+}
+
+// branch is the name goavro gives the column's type in a union.
+func (c avroColumn) branch() string {
+	switch c.logical {
+	case "timestamp-micros", "date", "decimal":
+		return c.avro + "." + c.logical
+	}
+	return c.avro
+}
+
+var avroInvalidName = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// avroName makes name a valid Avro name.
+func avroName(name string) string {
+	name = avroInvalidName.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// newAvroColumn maps a PostgreSQL column to its Avro type:
+//
+//	int2, int4                    int
+//	int8, oid, xid                long
+//	float4, float8                float, double
+//	numeric(p,s)                  bytes, logical type decimal(p,s)
+//	numeric                       string, unconstrained numerics have no fixed scale
+//	bool                          boolean
+//	bytea                         bytes
+//	uuid                          string, logical type uuid
+//	date                          int, logical type date
+//	timestamptz                   long, logical type timestamp-micros
+//	timestamp                     long, logical type local-timestamp-micros
+//	anything else                 string (arrays and json as JSON)
+func newAvroColumn(c schemaColumn) avroColumn {
+	column := avroColumn{column: c.Name, name: avroName(c.Name), avro: "string"}
+	if c.DataType == "ARRAY" {
+		column.schema = column.avro
+		return column
+	}
+	switch c.UDTName {
+	case "int2", "int4":
+		column.avro = "int"
+	case "int8", "oid", "xid":
+		column.avro = "long"
+	case "float4":
+		column.avro = "float"
+	case "float8":
+		column.avro = "double"
+	case "numeric":
+		if c.Precision != nil && c.Scale != nil && *c.Precision > 0 {
+			column.avro, column.logical = "bytes", "decimal"
+			column.schema = map[string]any{"type": "bytes", "logicalType": "decimal", "precision": *c.Precision, "scale": *c.Scale}
+			return column
+		}
+	case "bool":
+		column.avro = "boolean"
+	case "bytea":
+		column.avro = "bytes"
+	case "uuid":
+		column.logical = "uuid"
+	case "date":
+		column.avro, column.logical = "int", "date"
+	case "timestamptz":
+		column.avro, column.logical = "long", "timestamp-micros"
+	case "timestamp":
+		column.avro, column.logical = "long", "local-timestamp-micros"
+	}
+	column.schema = column.avro
+	if column.logical != "" {
+		column.schema = map[string]any{"type": column.avro, "logicalType": column.logical}
+	}
+	return column
+}
+
+// avroColumns returns the Avro fields of t's rows: the sink table schema's
+// columns followed by snapshot_tm.
+func avroColumns(tableSchema string) ([]avroColumn, error) {
+	columns, err := parseSchemaColumns(tableSchema)
+	if err != nil {
+		return nil, err
+	}
+	var avroColumns []avroColumn
+	for _, c := range columns {
+		avroColumns = append(avroColumns, newAvroColumn(c))
+	}
+	return append(avroColumns, newAvroColumn(schemaColumn{Name: "snapshot_tm", UDTName: "timestamptz"})), nil
+}
+
+// avroRecordSchema returns the record schema of columns. Every field is a
+// nullable union defaulting to null, so columns added to the source remain
+// backward compatible.
+func avroRecordSchema(name string, columns []avroColumn) (string, error) {
+	var fields []any
+	for _, c := range columns {
+		fields = append(fields, map[string]any{"name": c.name, "type": []any{"null", c.schema}, "default": nil})
+	}
+	b, err := json.Marshal(map[string]any{"type": "record", "name": avroName(name), "namespace": "leftshove", "fields": fields})
+	if err != nil {
+		return "", fmt.Errorf("avro schema marshal error: %v", err)
+	}
+	return string(b), nil
+}
+
+// avroSchema returns the Avro schema of t's rows.
+func avroSchema(t table) (string, error) {
+	tableSchema, err := sinkTableSchema(t)
+	if err != nil {
+		return "", err
+	}
+	columns, err := avroColumns(tableSchema)
+	if err != nil {
+		return "", err
+	}
+	return avroRecordSchema(sinkTableName(t), columns)
+}
+
+// native converts a row value to the goavro native form of the column's union.
+func (c avroColumn) native(v any) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	var native any
+	var err error
+	switch c.branch() {
+	case "int":
+		native, err = cast.ToInt32E(v)
+	case "long":
+		if c.logical == "local-timestamp-micros" {
+			var t time.Time
+			t, err = rowTime(v)
+			// wall clock time, as read from the source
+			native = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC).UnixMicro()
+			break
+		}
+		native, err = cast.ToInt64E(v)
+	case "float":
+		native, err = cast.ToFloat32E(v)
+	case "double":
+		native, err = cast.ToFloat64E(v)
+	case "boolean":
+		native, err = cast.ToBoolE(v)
+	case "bytes":
+		switch v := v.(type) {
+		case []byte:
+			native = v
+		default:
+			var s string
+			s, err = cast.ToStringE(v)
+			native = []byte(s)
+		}
+	case "bytes.decimal":
+		var s string
+		s, err = cast.ToStringE(v)
+		if err != nil {
+			break
+		}
+		r, ok := new(big.Rat).SetString(s)
+		if !ok {
+			return nil, fmt.Errorf("invalid decimal %q", s)
+		}
+		native = r
+	case "int.date", "long.timestamp-micros":
+		native, err = rowTime(v)
+	default:
+		switch v := v.(type) {
+		case string:
+			native = v
+		case []byte:
+			native = string(v)
+		case time.Time:
+			native = v.Format(time.RFC3339Nano)
+		case map[string]any, []any:
+			var b []byte
+			b, err = json.Marshal(v)
+			native = string(b)
+		default:
+			native, err = cast.ToStringE(v)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return goavro.Union(c.branch(), native), nil
+}
+
+// avroRecord converts a row to the goavro native form of its record, columns
+// missing from the row are null and row fields without a column are dropped.
+func avroRecord(columns []avroColumn, row map[string]any) (map[string]any, error) {
+	record := make(map[string]any, len(columns))
+	for _, c := range columns {
+		v, err := c.native(row[c.column])
+		if err != nil {
+			return nil, fmt.Errorf("avro column %v value error: %v", c.column, err)
+		}
+		record[c.name] = v
+	}
+	return record, nil
+}
+
+// avroFailures counts rows that could not be encoded by table key, a window
+// with encoding failures doesn't advance the nms.
+var avroFailures = struct {
+	sync.Mutex
+	count map[string]int
+}{
+	count: make(map[string]int),
+}
+
+// avroEncodingErrors returns an error if rows of t's window couldn't be
+// encoded, and resets the count for the next window.
+func avroEncodingErrors(t table) error {
+	avroFailures.Lock()
+	defer avroFailures.Unlock()
+	count := avroFailures.count[deliveredTableKey(t)]
+	delete(avroFailures.count, deliveredTableKey(t))
+	if count > 0 {
+		return fmt.Errorf("%v rows could not be encoded as avro", count)
+	}
+	return nil
+}
+
+func avroEncodingFailed(tableKey string) {
+	avroFailures.Lock()
+	defer avroFailures.Unlock()
+	avroFailures.count[tableKey]++
+}
+
+func init() {
+	spec := service.NewConfigSpec().
+		Summary("Encodes captured rows as Avro in the Confluent wire format.").
+		Field(service.NewStringField("table")).
+		Field(service.NewStringField("table_schema")).
+		Field(service.NewStringField("record_name")).
+		Field(service.NewIntField("schema_id"))
+	err := service.RegisterProcessor("leftshove_avro", spec, func(conf *service.ParsedConfig, mgr *service.Resources) (service.Processor, error) {
+		var p avroProcessor
+		var err error
+		if p.tableKey, err = conf.FieldString("table"); err != nil {
+			return nil, err
+		}
+		tableSchema, err := conf.FieldString("table_schema")
+		if err != nil {
+			return nil, err
+		}
+		if p.columns, err = avroColumns(tableSchema); err != nil {
+			return nil, err
+		}
+		recordName, err := conf.FieldString("record_name")
+		if err != nil {
+			return nil, err
+		}
+		schema, err := avroRecordSchema(recordName, p.columns)
+		if err != nil {
+			return nil, err
+		}
+		if p.codec, err = goavro.NewCodec(schema); err != nil {
+			return nil, fmt.Errorf("avro codec error: %v", err)
+		}
+		if p.schemaID, err = conf.FieldInt("schema_id"); err != nil {
+			return nil, err
+		}
+		p.logger = mgr.Logger()
+		return &p, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	spec = service.NewConfigSpec().
+		Summary("Appends captured rows to an Avro object container file.").
+		Field(service.NewStringField("path")).
+		Field(service.NewStringField("table_schema")).
+		Field(service.NewStringField("record_name")).
+		Field(service.NewBatchPolicyField("batching"))
+	err = service.RegisterBatchOutput("leftshove_avro_file", spec, func(conf *service.ParsedConfig, mgr *service.Resources) (out service.BatchOutput, batchPolicy service.BatchPolicy, maxInFlight int, err error) {
+		var o avroFileOutput
+		if o.path, err = conf.FieldString("path"); err != nil {
+			return
+		}
+		var tableSchema string
+		if tableSchema, err = conf.FieldString("table_schema"); err != nil {
+			return
+		}
+		if o.columns, err = avroColumns(tableSchema); err != nil {
+			return
+		}
+		var recordName string
+		if recordName, err = conf.FieldString("record_name"); err != nil {
+			return
+		}
+		if o.schema, err = avroRecordSchema(recordName, o.columns); err != nil {
+			return
+		}
+		if batchPolicy, err = conf.FieldBatchPolicy("batching"); err != nil {
+			return
+		}
+		return &o, batchPolicy, 1, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+type avroProcessor struct {
+	tableKey string
+	columns  []avroColumn
+	codec    *goavro.Codec
+	schemaID int
+	logger   *service.Logger
+}
+
+// Process replaces the row with its Avro encoding, prefixed with the magic
+// byte and schema id. Rows that can't be encoded are dropped and fail the window.
+func (p *avroProcessor) Process(ctx context.Context, msg *service.Message) (service.MessageBatch, error) {
+	b, err := p.encode(msg)
+	if err != nil {
+		p.logger.Errorf("avro encoding error: %v", err)
+		avroEncodingFailed(p.tableKey)
+		return nil, nil
+	}
+	msg.SetBytes(b)
+	return service.MessageBatch{msg}, nil
+}
+
+func (p *avroProcessor) encode(msg *service.Message) ([]byte, error) {
+	structured, err := msg.AsStructured()
+	if err != nil {
+		return nil, fmt.Errorf("message read error: %v", err)
+	}
+	row, ok := structured.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("message is not an object: %T", structured)
+	}
+	record, err := avroRecord(p.columns, row)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header[1:], uint32(p.schemaID))
+	return p.codec.BinaryFromNative(header, record)
+}
+
+func (p *avroProcessor) Close(ctx context.Context) error {
+	return nil
+}
+
+type avroFileOutput struct {
+	path    string
+	schema  string
+	columns []avroColumn
+	file    *os.File
+	writer  *goavro.OCFWriter
+}
+
+// Connect opens the container file, appending to it if it exists.
+func (o *avroFileOutput) Connect(ctx context.Context) error {
+	f, err := os.OpenFile(o.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("avro file open error: %v", err)
+	}
+	writer, err := goavro.NewOCFWriter(goavro.OCFConfig{W: f, Schema: o.schema, CompressionName: goavro.CompressionSnappyLabel})
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("avro file writer error: %v", err)
+	}
+	o.file, o.writer = f, writer
+	return nil
+}
+
+// WriteBatch appends the batch's rows as one block.
+func (o *avroFileOutput) WriteBatch(ctx context.Context, batch service.MessageBatch) error {
+	if o.writer == nil {
+		return service.ErrNotConnected
+	}
+	var records []any
+	for _, msg := range batch {
+		structured, err := msg.AsStructured()
+		if err != nil {
+			return fmt.Errorf("avro file message read error: %v", err)
+		}
+		row, ok := structured.(map[string]any)
+		if !ok {
+			return fmt.Errorf("avro file message is not an object: %T", structured)
+		}
+		record, err := avroRecord(o.columns, row)
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+	}
+	err := o.writer.Append(records)
+	if err != nil {
+		return fmt.Errorf("avro file append error: %v", err)
+	}
+	return nil
+}
+
+func (o *avroFileOutput) Close(ctx context.Context) error {
+	if o.file == nil {
+		return nil
+	}
+	o.writer = nil
+	return o.file.Close()
+}
+
+// avroEncoding reports whether rows are encoded as Avro, OUTPUT_ENCODING=AVRO.
+func avroEncoding() bool {
+	return strings.EqualFold(os.Getenv("OUTPUT_ENCODING"), "AVRO")
+}
+
+// newAvroProcessor registers t's Avro schema under its topic's value subject
+// and returns the processor encoding its rows with it.
+func newAvroProcessor(t table) (string, error) {
+	schema, err := avroSchema(t)
+	if err != nil {
+		return "", err
+	}
+	schemaID, err := registerAvroSchema(kafkaTopicName(t)+"-value", schema)
+	if err != nil {
+		return "", err
+	}
+	tableSchema, err := sinkTableSchema(t)
+	if err != nil {
+		return "", err
+	}
+	processorYAML := `leftshove_avro:
+  table: {table}
+  table_schema: {tableSchema}
+  record_name: {recordName}
+  schema_id: {schemaID}`
+	return strings.NewReplacer(
+		"{table}", yamlString(deliveredTableKey(t)),
+		"{tableSchema}", yamlString(tableSchema),
+		"{recordName}", yamlString(sinkTableName(t)),
+		"{schemaID}", cast.ToString(schemaID),
+	).Replace(processorYAML), nil
+}
+
+// newAvroFileStreamConfig registers t's Avro schema under its sink table's
+// value subject and returns the output appending its rows to the container
+// file of that schema id, a schema change starts a new file.
+func newAvroFileStreamConfig(t table) (string, error) {
+	schema, err := avroSchema(t)
+	if err != nil {
+		return "", err
+	}
+	schemaID, err := registerAvroSchema(sinkTableName(t)+"-value", schema)
+	if err != nil {
+		return "", err
+	}
+	tableSchema, err := sinkTableSchema(t)
+	if err != nil {
+		return "", err
+	}
+	outputYAML := `leftshove_avro_file:
+  path: {path}
+  table_schema: {tableSchema}
+  record_name: {recordName}
+  batching:
+    count: 10000
+    period: "1s"`
+	return strings.NewReplacer(
+		"{path}", yamlString("./output/"+sinkTableName(t)+"."+cast.ToString(schemaID)+".avro"),
+		"{tableSchema}", yamlString(tableSchema),
+		"{recordName}", yamlString(sinkTableName(t)),
+	).Replace(outputYAML), nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+// backfillCommand runs `backfill`, capturing a table's rows with nms in a
+// window again as a job recorded in nmsrecaptures. The table's nms, and so its
+// live capture, are left untouched.
+func backfillCommand(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	tableName := fs.String("table", "", "table to backfill, [schema.]name")
+	dsn := fs.Int64("dsn", 0, "source of the table, if its name is ambiguous")
+	fromFlag := fs.String("from", "", "window start, exclusive (ie. '2024-01-01 00:00:00')")
+	toFlag := fs.String("to", "", "window end, inclusive")
+	staging := fs.String("staging", "", "sink table (or topic) to write to instead of the table's sink")
+	fs.Parse(args)
+	if *tableName == "" || *fromFlag == "" || *toFlag == "" {
+		return fmt.Errorf("backfill: -table, -from and -to are required")
+	}
+	if *staging != "" {
+		err := checkStagingOutput()
+		if err != nil {
+			return fmt.Errorf("backfill: %v", err)
+		}
+	}
+
+	nmsDB, err := nmsDBOpen()
+	if err != nil {
+		return fmt.Errorf("backfill nmsdbopen error: %v", err)
+	}
+	defer nmsDB.Close()
+	tables, err := nmsTablesQuery(nmsDB, false)
+	if err != nil {
+		return fmt.Errorf("backfill nmstablesquery error: %v", err)
+	}
+	t, err := findTable(tables, *tableName, *dsn)
+	if err != nil {
+		return fmt.Errorf("backfill: %v", err)
+	}
+	t.rules, err = loadUserRules()
+	if err != nil {
+		return fmt.Errorf("backfill: %v", err)
+	}
+	dbURL := os.Getenv("PG_DB_URL_" + cast.ToString(t.DSNEnum))
+	pgPool, err := getPGConnection(dbURL)
+	if err != nil {
+		return fmt.Errorf("pg connection failure: %v", err)
+	}
+	defer pgPool.Close()
+	err = refreshTypeKeys(&t, pgPool, nmsDB)
+	if err != nil {
+		return fmt.Errorf("backfill: %v", err)
+	}
+	clock, err := getSourceClock(pgPool)
+	if err != nil {
+		return fmt.Errorf("backfill getsourceclock error: %v", err)
+	}
+	r := recapture{sinkTable: *staging}
+	r.from, err = cast.ToTimeInDefaultLocationE(*fromFlag, clock.location)
+	if err != nil {
+		return fmt.Errorf("backfill: invalid -from: %v", err)
+	}
+	r.to, err = cast.ToTimeInDefaultLocationE(*toFlag, clock.location)
+	if err != nil {
+		return fmt.Errorf("backfill: invalid -to: %v", err)
+	}
+	if !r.to.After(r.from) {
+		return fmt.Errorf("backfill: window end %v is not after its start %v", r.to, r.from)
+	}
+
+	r.id, err = startRecapture(nmsDB, t, r, "backfill")
+	if err != nil {
+		return err
+	}
+	log.Printf("backfill job %v: table %v.%v\tfrom: %v\tto: %v\n", r.id, t.DSNEnum, t.Name, r.from.Format("2006-01-02 15:04:05"), r.to.Format("2006-01-02 15:04:05"))
+	captureErr := captureRange(dbURL, t, r, pgPool, nmsDB)
+	err = finishRecapture(nmsDB, r.id, captureErr, false)
+	if captureErr != nil {
+		return fmt.Errorf("backfill job %v failure: %v", r.id, captureErr)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("backfill job %v: done\n", r.id)
+	return nil
+}
+
+// checkStagingOutput returns an error if OUTPUT_TYPE's sink can't write a
+// window to a staging table without touching the live table's sink. A Benthos
+// output template must name its sink with {sink_name}.
+func checkStagingOutput() error {
+	switch outputType := os.Getenv("OUTPUT_TYPE"); outputType {
+	case "BQ", "KAFKA", "PG", "CLICKHOUSE", "DUCKDB", "ICEBERG", "FILE":
+		return nil
+	case "BENTHOS":
+		b, err := os.ReadFile(os.Getenv("BENTHOS_OUTPUT_CONF_FILE"))
+		if err != nil {
+			return fmt.Errorf("output file read error: %v", err)
+		}
+		if !strings.Contains(string(b), "{sink_name}") {
+			return fmt.Errorf("-staging requires the BENTHOS_OUTPUT_CONF_FILE template to name its sink with {sink_name}")
+		}
+		return nil
+	default:
+		return fmt.Errorf("-staging is not supported by OUTPUT_TYPE %q", outputType)
+	}
+}
@@ -1,25 +1,56 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/benthosdev/benthos/v4/public/service"
 	"github.com/spf13/cast"
 
-	// Import only pure Benthos components, switch with `components/all` for all
-	// standard components.
+	// Import the standard components of `components/all` but amqp1, whose
+	// go-amqp version clashes with the Iceberg Azure client, and pure/extended,
+	// which holds no outputs and doesn't link with its parquet dependency.
+	_ "github.com/benthosdev/benthos/v4/public/components/amqp09"
+	_ "github.com/benthosdev/benthos/v4/public/components/avro"
+	_ "github.com/benthosdev/benthos/v4/public/components/aws"
+	_ "github.com/benthosdev/benthos/v4/public/components/azure"
+	_ "github.com/benthosdev/benthos/v4/public/components/beanstalkd"
+	_ "github.com/benthosdev/benthos/v4/public/components/cassandra"
+	_ "github.com/benthosdev/benthos/v4/public/components/confluent"
+	_ "github.com/benthosdev/benthos/v4/public/components/dgraph"
+	_ "github.com/benthosdev/benthos/v4/public/components/elasticsearch"
 	_ "github.com/benthosdev/benthos/v4/public/components/gcp"
+	_ "github.com/benthosdev/benthos/v4/public/components/hdfs"
+	_ "github.com/benthosdev/benthos/v4/public/components/influxdb"
 	_ "github.com/benthosdev/benthos/v4/public/components/io"
+	_ "github.com/benthosdev/benthos/v4/public/components/jaeger"
+	_ "github.com/benthosdev/benthos/v4/public/components/kafka"
+	_ "github.com/benthosdev/benthos/v4/public/components/maxmind"
+	_ "github.com/benthosdev/benthos/v4/public/components/memcached"
+	_ "github.com/benthosdev/benthos/v4/public/components/mongodb"
+	_ "github.com/benthosdev/benthos/v4/public/components/mqtt"
+	_ "github.com/benthosdev/benthos/v4/public/components/nanomsg"
+	_ "github.com/benthosdev/benthos/v4/public/components/nats"
+	_ "github.com/benthosdev/benthos/v4/public/components/nsq"
+	_ "github.com/benthosdev/benthos/v4/public/components/otlp"
+	_ "github.com/benthosdev/benthos/v4/public/components/prometheus"
 	_ "github.com/benthosdev/benthos/v4/public/components/pure"
+	_ "github.com/benthosdev/benthos/v4/public/components/pusher"
+	_ "github.com/benthosdev/benthos/v4/public/components/redis"
+	_ "github.com/benthosdev/benthos/v4/public/components/sftp"
+	_ "github.com/benthosdev/benthos/v4/public/components/snowflake"
 	_ "github.com/benthosdev/benthos/v4/public/components/sql"
+	_ "github.com/benthosdev/benthos/v4/public/components/statsd"
 )
 
 type benthosStreamConfig struct {
 	inputYAML     string
-	processorYAML string
+	cacheYAML     string
+	processorYAML []string
 	outputYAML    string
 }
 
@@ -36,8 +67,15 @@ func newStream(dbURL string, t table) (*service.Stream, error) {
 		return nil, fmt.Errorf("addinputyaml failed: %v : %v", t.Name, err)
 	}
 
-	if conf.processorYAML != "" {
-		err = builder.AddProcessorYAML(conf.processorYAML)
+	if conf.cacheYAML != "" {
+		err = builder.AddCacheYAML(conf.cacheYAML)
+		if err != nil {
+			return nil, fmt.Errorf("addcacheyaml failed: %v : %v", t.Name, err)
+		}
+	}
+
+	for _, processorYAML := range conf.processorYAML {
+		err = builder.AddProcessorYAML(processorYAML)
 		if err != nil {
 			return nil, fmt.Errorf("addprocessoryaml failed: %v : %v", t.Name, err)
 		}
@@ -68,21 +106,113 @@ file:
 	if err != nil {
 		return nil, fmt.Errorf("builder.build() failed: %v : %v", t.Name, err)
 	}
+	// the hash key is kept out of the config written to disk
+	conf.inputYAML, err = newInputConfig(dbURL, redactQuery(t))
+	if err != nil {
+		return nil, fmt.Errorf("newinputconfig() failed: %v : %v", t.Name, err)
+	}
 	writeConfigFile(t, conf)
 	return stream, nil
 }
 
-func newStreamConfig(dbURL string, t table) (benthosStreamConfig, error) {
-	var conf benthosStreamConfig
+// newInputConfig returns the sql_raw input reading t's window.
+func newInputConfig(dbURL string, t table) (string, error) {
 	inputYAML := `sql_raw:
   driver: "postgres"
-  dsn: "{dsn}"
-  query: "{query}"`
-	inputConf := strings.Replace(strings.Replace(inputYAML, "{dsn}", dbURL, 1), "{query}", t.Query, 1)
+  dsn: {dsn}
+  query: {query}`
+	inputConf := strings.Replace(strings.Replace(inputYAML, "{dsn}", yamlString(dbURL), 1), "{query}", yamlString(t.Query), 1)
+	if len(t.QueryArgs) > 0 {
+		args, err := json.Marshal(t.QueryArgs)
+		if err != nil {
+			return "", fmt.Errorf("query args marshal error: %v", err)
+		}
+		inputConf += "\n  args_mapping: " + yamlString("root = "+string(args))
+	}
+	return inputConf, nil
+}
+
+// redactQuery returns t with the COLUMN_HASH_KEY bind parameter, or its
+// literal in queries which cannot take parameters, replaced by a placeholder.
+func redactQuery(t table) table {
+	key := os.Getenv("COLUMN_HASH_KEY")
+	if key == "" {
+		return t
+	}
+	const redacted = "<COLUMN_HASH_KEY>"
+	t.QueryArgs = append([]string(nil), t.QueryArgs...)
+	for i, arg := range t.QueryArgs {
+		if arg == key {
+			t.QueryArgs[i] = redacted
+		}
+	}
+	t.Query = strings.ReplaceAll(t.Query, quoteLiteral(key), quoteLiteral(redacted))
+	return t
+}
+
+func newStreamConfig(dbURL string, t table) (benthosStreamConfig, error) {
+	var conf benthosStreamConfig
+	inputConf, err := newInputConfig(dbURL, t)
+	if err != nil {
+		return conf, err
+	}
 	conf.inputYAML = inputConf
 	// err = builder.AddProcessorYAML(`bloblang: 'root = content().uppercase()'`)
 	// panicOnErr(err)
+	// drop rows already delivered by the previous window's overlap
+	if lookbackDuration(t) > 0 && len(t.PKeyColumns) > 0 {
+		cacheYAML := `label: delivered
+leftshove_delivered:
+  table: "{tableKey}"`
+		conf.cacheYAML = strings.Replace(cacheYAML, "{tableKey}", deliveredTableKey(t), 1)
+		processorYAML := `dedupe:
+  cache: delivered
+  key: '{pkey}|${! json("{nmsColumn}") }'
+  drop_on_err: false`
+		var pkeys []string
+		for _, column := range t.PKeyColumns {
+			pkeys = append(pkeys, `${! json("`+column+`") }`)
+		}
+		conf.processorYAML = append(conf.processorYAML, strings.Replace(strings.Replace(processorYAML, "{pkey}", strings.Join(pkeys, "|"), 1), "{nmsColumn}", t.NMSColumn, 1))
+	}
+	// sanitize after the dedupe so rows already delivered aren't counted again
+	sanitizedProcessor, err := newSanitizedProcessor(t)
+	if err != nil {
+		return conf, fmt.Errorf("newsanitizedprocessor() error: %v", err)
+	}
+	if sanitizedProcessor != "" {
+		conf.processorYAML = append(conf.processorYAML, sanitizedProcessor)
+	}
 	outputType := os.Getenv("OUTPUT_TYPE")
+	arraysProcessor, err := newArraysProcessor(t, outputType)
+	if err != nil {
+		return conf, fmt.Errorf("newarraysprocessor() error: %v", err)
+	}
+	if arraysProcessor != "" {
+		conf.processorYAML = append(conf.processorYAML, arraysProcessor)
+	}
+	if outputType == "KAFKA" {
+		conf.processorYAML = append(conf.processorYAML, newKafkaHeadersProcessor(t))
+	}
+	userProcessors, err := tableProcessorYAML(t)
+	if err != nil {
+		return conf, fmt.Errorf("tableprocessoryaml() error: %v", err)
+	}
+	conf.processorYAML = append(conf.processorYAML, userProcessors...)
+	if avroEncoding() {
+		switch outputType {
+		case "KAFKA":
+			processorYAML, err := newAvroProcessor(t)
+			if err != nil {
+				return conf, fmt.Errorf("newavroprocessor() error: %v", err)
+			}
+			conf.processorYAML = append(conf.processorYAML, processorYAML)
+		case "FILE":
+			// encoded by the leftshove_avro_file output
+		default:
+			return conf, fmt.Errorf("avro encoding is only supported by the KAFKA and FILE outputs")
+		}
+	}
 	switch outputType {
 	case "BQ":
 		projectID := os.Getenv("BQ_PROJECT")
@@ -97,16 +227,70 @@ func newStreamConfig(dbURL string, t table) (benthosStreamConfig, error) {
 		if err != nil {
 			fmt.Println(err)
 		}
+		if avroEncoding() {
+			outputYAML, err := newAvroFileStreamConfig(t)
+			if err != nil {
+				return conf, fmt.Errorf("newavrofilestreamconfig() error: %v", err)
+			}
+			conf.outputYAML = outputYAML
+			break
+		}
 		outputYAML := `file:
   path: ./output/{tableName}.json
   codec: lines`
-		outputYAML = strings.Replace(outputYAML, "{tableName}", t.Name, 1)
+		outputYAML = strings.Replace(outputYAML, "{tableName}", sinkTableName(t), 1)
+		conf.outputYAML = outputYAML
+	case "KAFKA":
+		outputYAML, err := newKafkaStreamConfig(t)
+		if err != nil {
+			return conf, fmt.Errorf("newkafkastreamconfig() error: %v", err)
+		}
+		conf.outputYAML = outputYAML
+	case "PG":
+		outputYAML, err := newPGSinkStreamConfig(t)
+		if err != nil {
+			return conf, fmt.Errorf("newpgsinkstreamconfig() error: %v", err)
+		}
+		conf.outputYAML = outputYAML
+	case "CLICKHOUSE":
+		outputYAML, err := newClickHouseStreamConfig(t)
+		if err != nil {
+			return conf, fmt.Errorf("newclickhousestreamconfig() error: %v", err)
+		}
+		conf.outputYAML = outputYAML
+	case "DUCKDB":
+		outputYAML, err := newDuckDBStreamConfig(t)
+		if err != nil {
+			return conf, fmt.Errorf("newduckdbstreamconfig() error: %v", err)
+		}
+		conf.outputYAML = outputYAML
+	case "ICEBERG":
+		outputYAML, err := newIcebergStreamConfig(t)
+		if err != nil {
+			return conf, fmt.Errorf("newicebergstreamconfig() error: %v", err)
+		}
+		conf.outputYAML = outputYAML
+	case "BENTHOS":
+		outputYAML, err := newBenthosOutputConfig(t)
+		if err != nil {
+			return conf, fmt.Errorf("newbenthosoutputconfig() error: %v", err)
+		}
 		conf.outputYAML = outputYAML
 	}
 	// log.Printf("conf: %+v", conf)
 	return conf, nil
 }
 
+// yamlString quotes s as a YAML double-quoted scalar, which shares its escaping
+// rules with JSON strings.
+func yamlString(s string) string {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
 func newBigQueryStreamConfig(t table) string {
 	projectID := os.Getenv("BQ_PROJECT")
 	datasetID := os.Getenv("BQ_DATASET_" + cast.ToString(t.DSNEnum))
@@ -138,23 +322,48 @@ gcp_bigquery:
     count: {batchCount}
     byte_size: {batchBytes}
     period: "{batchPeriod}"`
-	outputConf := strings.Replace(strings.Replace(strings.Replace(strings.Replace(outputYAML, "{projectID}", projectID, 1), "{datasetID}", datasetID, 1), "{tableID}", t.Name+"_cdc", 1), "{batchCount}", batchCount, 1)
+	outputConf := strings.Replace(strings.Replace(strings.Replace(strings.Replace(outputYAML, "{projectID}", projectID, 1), "{datasetID}", datasetID, 1), "{tableID}", sinkTableName(t), 1), "{batchCount}", batchCount, 1)
 	outputConf = strings.Replace(strings.Replace(outputConf, "{batchBytes}", batchBytes, 1), "{batchPeriod}", batchPeriod, 1)
 	return outputConf
 }
 
+// newBenthosOutputConfig renders the BENTHOS_OUTPUT_CONF_FILE output template
+// for t's window. On top of the table template variables, it fills
+// {window_start} and {window_end} (RFC 3339) and {sink_name}. Values are
+// quoted YAML strings, so each variable must be a whole scalar.
+func newBenthosOutputConfig(t table) (string, error) {
+	outputFile := os.Getenv("BENTHOS_OUTPUT_CONF_FILE")
+	if outputFile == "" {
+		return "", fmt.Errorf("missing env var: benthos_output_conf_file")
+	}
+	b, err := os.ReadFile(outputFile)
+	if err != nil {
+		return "", fmt.Errorf("output file read error: %v", err)
+	}
+	vars := append(tableTemplateValues(t),
+		"{window_start}", t.NMS.Add(-lookbackDuration(t)).Format(time.RFC3339Nano),
+		"{window_end}", t.NewNMS.Format(time.RFC3339Nano),
+		"{sink_name}", sinkTableName(t),
+	)
+	for i := 1; i < len(vars); i += 2 {
+		vars[i] = yamlString(vars[i])
+	}
+	return strings.NewReplacer(vars...).Replace(string(b)), nil
+}
+
 func writeConfigFile(t table, conf benthosStreamConfig) {
 	err := os.MkdirAll("stream_configs", 0755)
 	if err != nil {
 		fmt.Println(err)
 	}
-	f, err := os.OpenFile("./stream_configs/"+cast.ToString(t.DSNEnum)+"_"+t.Name+".json", os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile("./stream_configs/"+cast.ToString(t.DSNEnum)+"_"+t.Schema+"."+t.Name+".json", os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		fmt.Println(err)
 	}
 	defer f.Close()
 
-	if _, err := fmt.Fprintf(f, "%v\n%v\n%v", conf.inputYAML, conf.processorYAML, conf.outputYAML); err != nil {
+	content := fmt.Sprintf("%v\n%v\n%v\n%v", conf.inputYAML, conf.cacheYAML, strings.Join(conf.processorYAML, "\n"), conf.outputYAML)
+	if _, err := fmt.Fprint(f, content); err != nil {
 		log.Printf("seed_state.json file write error:%v", err)
 	}
 }
@@ -12,7 +12,6 @@ import (
 	"strings"
 
 	"cloud.google.com/go/bigquery"
-	"github.com/Jeffail/gabs/v2"
 	"github.com/spf13/cast"
 	"google.golang.org/api/googleapi"
 )
@@ -35,6 +34,11 @@ func createBQtables() error {
 	if err != nil {
 		return fmt.Errorf("nmstablesquery error: %v", err)
 	}
+	rules, err := loadUserRules()
+	if err != nil {
+		return fmt.Errorf("loaduserrules error: %v", err)
+	}
+	tables = withRules(tables, rules)
 
 	projectID := os.Getenv("BQ_PROJECT")
 	ctx := context.Background()
@@ -68,16 +72,16 @@ func createBQtables() error {
 			continue
 		}
 		datasetID := os.Getenv("BQ_DATASET_" + cast.ToString(t.DSNEnum))
-		bqTableName := t.Name + "_cdc"
+		bqTableName := sinkTableName(t)
 		tExists, tSchema, err := checkTableExists(datasetID, bqTableName, bigqueryClient)
 		if err != nil {
 			log.Printf("checktableexists():%v", err)
 		}
 
 		if !tExists {
-			_, bqSchema, err := pgSchemaToBqSchema(t.TableSchema)
+			_, bqSchema, err := tableBQSchema(t)
 			if err != nil {
-				return fmt.Errorf("pgschematobqschema() error: %v", err)
+				return fmt.Errorf("tablebqschema() error: %v", err)
 			}
 
 			err = createBigQueryTableWithSchema(datasetID, bqTableName, bigqueryClient, bqSchema)
@@ -90,24 +94,34 @@ func createBQtables() error {
 			}
 
 		} else {
-			pgBQSchemaBytes, _, err := pgSchemaToBqSchema(t.TableSchema)
+			pgBQSchemaBytes, _, err := tableBQSchema(t)
 			if err != nil {
-				return fmt.Errorf("pgschematobqschema() error: %v", err)
+				return fmt.Errorf("tablebqschema() error: %v", err)
 			}
 			unchanged := compareBQSchemas(pgBQSchemaBytes, tSchema)
-			log.Printf("BigQuery table %v:%v.%v exists, unchanged = %v", projectID, datasetID, t.Name, unchanged)
+			log.Printf("BigQuery table %v:%v.%v exists, unchanged = %v", projectID, datasetID, bqTableName, unchanged)
 			// to do: add new fields to bq table if any
 		}
-		vExists, _, err := checkTableExists(datasetID, t.Name, bigqueryClient)
+		vExists, _, err := checkTableExists(datasetID, sinkViewName(t), bigqueryClient)
 		if err != nil {
 			log.Printf("checktableexists():%v", err)
 		}
-		if !vExists && t.PKeyColumn != "" {
-			err = createBigQueryPKeyView(datasetID, t.Name, t.PKeyColumn, bigqueryClient)
+		if !vExists && len(t.PKeyColumns) > 0 {
+			err = createBigQueryPKeyView(datasetID, sinkViewName(t), bqTableName, t.PKeyColumns, bigqueryClient)
 			if err != nil {
 				return fmt.Errorf("createbigquerypkeyview() error: %v", err)
 			}
 		}
+		if currentTableEnabled(t) {
+			_, bqSchema, err := tableBQSchema(t)
+			if err != nil {
+				return fmt.Errorf("tablebqschema() error: %v", err)
+			}
+			err = createBigQueryTableWithSchema(datasetID, sinkCurrentTableName(t), bigqueryClient, bqSchema)
+			if err != nil {
+				return fmt.Errorf("createbigquerytableWithschema() error: %v", err)
+			}
+		}
 	}
 	return nil
 }
@@ -184,12 +198,12 @@ func createBigQueryTableWithSchema(datasetID, tableID string, client *bigquery.C
 	return nil
 }
 
-func createBigQueryPKeyView(datasetID, tableID, pKeyColumn string, client *bigquery.Client) error {
+func createBigQueryPKeyView(datasetID, tableID, cdcTableID string, pKeyColumns []string, client *bigquery.Client) error {
 	ctx := context.Background()
-	tableFullID := client.Project() + "." + "." + datasetID + "." + tableID
+	tableFullID := client.Project() + "." + datasetID + "." + cdcTableID
 	viewQuery := "SELECT * FROM `{tableFullID}` WHERE ( {pkey} , snapshot_tm ) in (SELECT ({pkey}, max(snapshot_tm)) FROM `{tableFullID}` GROUP BY {pkey})"
 	viewQuery = strings.Replace(viewQuery, "{tableFullID}", tableFullID, 2)
-	viewQuery = strings.Replace(viewQuery, "{pkey}", pKeyColumn, 3)
+	viewQuery = strings.Replace(viewQuery, "{pkey}", bqColumnList(pKeyColumns), 3)
 
 	metaData := &bigquery.TableMetadata{
 		ViewQuery: viewQuery,
@@ -206,6 +220,95 @@ func createBigQueryPKeyView(datasetID, tableID, pKeyColumn string, client *bigqu
 	return nil
 }
 
+// currentTableEnabled reports whether t's rows are merged into a deduplicated
+// <table>_current BigQuery table after each window. Windows written to a
+// staging table aren't merged.
+func currentTableEnabled(t table) bool {
+	return cast.ToBool(os.Getenv("BQ_CURRENT_TABLE_"+cast.ToString(t.DSNEnum))) && len(t.PKeyColumns) > 0 && t.stagingTable == ""
+}
+
+// createBigQueryStagingTable creates t's staging table with the schema of its sink table.
+func createBigQueryStagingTable(t table) error {
+	ctx := context.Background()
+	client, err := bigquery.NewClient(ctx, os.Getenv("BQ_PROJECT"))
+	if err != nil {
+		return fmt.Errorf("bigquery.NewClient: %v", err)
+	}
+	defer client.Close()
+	_, bqSchema, err := tableBQSchema(t)
+	if err != nil {
+		return fmt.Errorf("tablebqschema() error: %v", err)
+	}
+	return createBigQueryTableWithSchema(os.Getenv("BQ_DATASET_"+cast.ToString(t.DSNEnum)), t.stagingTable, client, bqSchema)
+}
+
+// bqColumnList returns columns as a comma separated list of quoted BigQuery identifiers.
+func bqColumnList(columns []string) string {
+	var quoted []string
+	for _, column := range columns {
+		quoted = append(quoted, "`"+column+"`")
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// mergeBigQueryCurrentTable merges the latest version of each row appended to
+// t's _cdc table since the window's capture started into its _current table.
+func mergeBigQueryCurrentTable(t table) error {
+	ctx := context.Background()
+	projectID := os.Getenv("BQ_PROJECT")
+	datasetID := os.Getenv("BQ_DATASET_" + cast.ToString(t.DSNEnum))
+	client, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return fmt.Errorf("bigquery.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	_, bqSchema, err := tableBQSchema(t)
+	if err != nil {
+		return fmt.Errorf("tablebqschema() error: %v", err)
+	}
+	var pkeyMatch []string
+	for _, column := range t.PKeyColumns {
+		pkeyMatch = append(pkeyMatch, "target.`"+column+"` = source.`"+column+"`")
+	}
+	var updates []string
+	for _, field := range bqSchema {
+		updates = append(updates, "`"+field.Name+"` = source.`"+field.Name+"`")
+	}
+	mergeQuery := `MERGE ` + "`{project}.{dataset}.{currentTable}`" + ` AS target
+USING (
+	SELECT * EXCEPT(leftshove_rn) FROM (
+		SELECT *, ROW_NUMBER() OVER (PARTITION BY {pkey} ORDER BY snapshot_tm DESC) AS leftshove_rn
+		FROM ` + "`{project}.{dataset}.{cdcTable}`" + `
+		WHERE snapshot_tm >= @captured_from
+	) WHERE leftshove_rn = 1
+) AS source
+ON {pkeyMatch}
+WHEN MATCHED AND source.snapshot_tm >= target.snapshot_tm THEN
+	UPDATE SET {updates}
+WHEN NOT MATCHED THEN
+	INSERT ROW`
+	mergeQuery = strings.ReplaceAll(strings.ReplaceAll(mergeQuery, "{project}", projectID), "{dataset}", datasetID)
+	mergeQuery = strings.Replace(strings.Replace(mergeQuery, "{currentTable}", sinkCurrentTableName(t), 1), "{cdcTable}", sinkTableName(t), 1)
+	mergeQuery = strings.Replace(strings.Replace(mergeQuery, "{pkey}", bqColumnList(t.PKeyColumns), 1), "{pkeyMatch}", strings.Join(pkeyMatch, " AND "), 1)
+	mergeQuery = strings.Replace(mergeQuery, "{updates}", strings.Join(updates, ", "), 1)
+
+	q := client.Query(mergeQuery)
+	q.Parameters = []bigquery.QueryParameter{{Name: "captured_from", Value: t.capturedFrom}}
+	job, err := q.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("merge query run error: %v", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("merge job wait error: %v", err)
+	}
+	if status.Err() != nil {
+		return fmt.Errorf("merge job completed with error: %v", status.Err())
+	}
+	return nil
+}
+
 func hasStatusCode(err error, code int) bool {
 	// https://go.dev/src/net/http/status.go
 	if e, ok := err.(*googleapi.Error); ok && e.Code == code {
@@ -249,107 +352,28 @@ func importJSONExplicitSchema(projectID, datasetID, tableID string) error {
 	return nil
 }
 
+// tableBQSchema returns the BigQuery schema of t's sink table, with its column rules applied.
+func tableBQSchema(t table) ([]byte, bigquery.Schema, error) {
+	tableSchema, err := sinkTableSchema(t)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pgSchemaToBqSchema(tableSchema)
+}
+
 func pgSchemaToBqSchema(tableSchema string) ([]byte, bigquery.Schema, error) {
 	var bqTableSchema bigquery.Schema
-	jsonParsed, err := gabs.ParseJSON([]byte(tableSchema))
+	columns, err := parseSchemaColumns(tableSchema)
 	if err != nil {
-		return nil, nil, fmt.Errorf("pgschematobqschema() tableschema parsejson: %v", err)
-	}
-	// tableID := jsonParsed.Path("table_name").Data().(string)
-	for _, column := range jsonParsed.S("columns").Children() {
-		columnName := column.Path("column_name").Data().(string)
-		columnType := column.Path("udt_name").Data().(string)
-		// is_nullable := column.Path("is_nullable").Data().(string)
-		// ordinal_position := column.Path("ordinal_position").Data().(string)
-		// column_default := column.Path("column_default").Data().(string)
-		// data_type := column.Path("data_type").Data().(string)
-		// character_maximum_length := column.Path("character_maximum_length").Data().(string)
-		// numeric_precision_radix := column.Path("numeric_precision_radix").Data().(string)
-		// dtd_identifier := column.Path("dtd_identifier").Data().(string)
-		// is_identity := column.Path("is_identity").Data().(string)
-
+		return nil, nil, fmt.Errorf("pgschematobqschema() %v", err)
+	}
+	for _, c := range columns {
 		var field bigquery.FieldSchema
-		field.Name = columnName
-		/*
-			// Benthos currently sends postgres arrays as string, not JSON array, causing errors. Defaulting to BQ string type for PG source array types
-				if columnType[0:1] == "_" || strings.HasSuffix(columnType, "vector") {
-					field.Repeated = true
-				}
-		*/
-		baseType := strings.TrimPrefix(columnType, "_")
-		// fmt.Printf("%v.%v : %v\n", tableID, columnName, baseType)
-		if columnType[0:1] == "_" || strings.HasSuffix(columnType, "vector") {
-			field.Type = bigquery.StringFieldType
-		} else {
-			// types float(n)
-			if strings.HasPrefix(baseType, "float") {
-				field.Type = bigquery.NumericFieldType
-				if column.Path("numeric_precision").Data() != nil && column.Path("numeric_precision").Data().(float64) != 0.0 {
-					field.Precision = int64(column.Path("numeric_precision").Data().(float64))
-				}
-				if column.Path("numeric_scale").Data() != nil && column.Path("numeric_scale").Data().(float64) != 0.0 {
-					field.Precision = int64(column.Path("numeric_scale").Data().(float64))
-				}
-			} else {
-				// types int(n), int(n)vector
-				if strings.HasPrefix(baseType, "int") && !strings.HasSuffix(baseType, "erval") {
-					field.Type = bigquery.IntegerFieldType
-				} else {
-					switch baseType {
-					case "abstime":
-						field.Type = bigquery.DateTimeFieldType
-					case "bool":
-						field.Type = bigquery.BooleanFieldType
-					case "bytea":
-						field.Type = bigquery.BytesFieldType
-					case "char":
-						field.Type = bigquery.StringFieldType
-					case "date":
-						field.Type = bigquery.DateFieldType
-					case "inet":
-						field.Type = bigquery.StringFieldType
-					case "interval":
-						field.Type = bigquery.StringFieldType
-					case "json":
-						field.Type = bigquery.StringFieldType
-					case "jsonb":
-						field.Type = bigquery.JSONFieldType 
-					case "ltree":
-						field.Type = bigquery.StringFieldType
-					case "name":
-						field.Type = bigquery.StringFieldType
-					case "numeric":
-						field.Type = bigquery.NumericFieldType
-						if column.Path("numeric_precision").Data() != nil && column.Path("numeric_precision").Data().(float64) != 0.0 {
-							field.Precision = int64(column.Path("numeric_precision").Data().(float64))
-						}
-						if column.Path("numeric_scale").Data() != nil && column.Path("numeric_scale").Data().(float64) != 0.0 {
-							field.Precision = int64(column.Path("numeric_scale").Data().(float64))
-						}
-					case "oid":
-						field.Type = bigquery.IntegerFieldType
-					case "oidvector":
-						field.Type = bigquery.IntegerFieldType
-					case "point":
-						field.Type = bigquery.StringFieldType
-					case "regproc":
-						field.Type = bigquery.StringFieldType
-					case "text":
-						field.Type = bigquery.StringFieldType
-					case "timestamp":
-						field.Type = bigquery.TimestampFieldType
-					case "timestamptz":
-						field.Type = bigquery.TimestampFieldType
-					case "varchar":
-						field.Type = bigquery.StringFieldType
-					case "xid":
-						field.Type = bigquery.IntegerFieldType
-					default:
-						field.Type = bigquery.StringFieldType
-					}
-				}
-			}
-		}
+		field.Name = c.Name
+		field.Type, field.Precision, field.Scale = bqFieldType(c)
+		// arrays are parsed into JSON arrays by the leftshove_arrays processor, see
+		// flattenArray for multi-dimensional arrays and NULL elements
+		field.Repeated = isArrayType(c.UDTName)
 		bqTableSchema = append(bqTableSchema, &field)
 	}
 	var snapshotTime bigquery.FieldSchema
@@ -363,6 +387,81 @@ func pgSchemaToBqSchema(tableSchema string) ([]byte, bigquery.Schema, error) {
 	return bqSchemaJSON, bqTableSchema, nil
 }
 
+// BigQuery NUMERIC and BIGNUMERIC limits: at most 9 (38) fractional digits and
+// 29 (38) integer digits.
+const (
+	bqNumericMaxScale       = 9
+	bqNumericMaxIntegers    = 29
+	bqBigNumericMaxScale    = 38
+	bqBigNumericMaxIntegers = 38
+)
+
+// bqFieldType maps a PostgreSQL column to its BigQuery type, precision and
+// scale, unless a type mapping sets its type. Array types map to their element
+// type, REPEATED:
+//
+//	udt_name                              BigQuery type
+//	int2, int4, int8, oid, xid            INTEGER
+//	int2vector, oidvector                 INTEGER
+//	float4, float8                        FLOAT64
+//	vector (pgvector)                     FLOAT64
+//	numeric(p,s), s <= 9, p-s <= 29       NUMERIC(p,s)
+//	numeric(p,s), s <= 38, p-s <= 38      BIGNUMERIC(p,s)
+//	numeric(p,s), larger                  STRING, exact text of the value
+//	numeric(p,s), s < 0                   as numeric(p-s,0)
+//	numeric(p,s), s > p                   as numeric(s,s)
+//	numeric                               BIGNUMERIC, unconstrained numerics can exceed NUMERIC's 38 digits
+//	bool                                  BOOL
+//	bytea                                 BYTES
+//	date                                  DATE
+//	timestamp, timestamptz                TIMESTAMP
+//	abstime                               DATETIME
+//	jsonb                                 JSON
+//	anything else                         STRING (json, text, uuid, inet, interval, ranges...)
+func bqFieldType(c schemaColumn) (bigquery.FieldType, int64, int64) {
+	if c.BQType != "" {
+		return bigquery.FieldType(c.BQType), 0, 0
+	}
+	switch strings.TrimPrefix(c.UDTName, "_") {
+	case "int2", "int4", "int8", "oid", "xid", "int2vector", "oidvector":
+		return bigquery.IntegerFieldType, 0, 0
+	case "float4", "float8", "vector":
+		return bigquery.FloatFieldType, 0, 0
+	case "numeric":
+		if c.Precision == nil || *c.Precision == 0 {
+			return bigquery.BigNumericFieldType, 0, 0
+		}
+		precision, scale := *c.Precision, int64(0)
+		if c.Scale != nil {
+			scale = *c.Scale
+		}
+		if scale < 0 {
+			precision, scale = precision-scale, 0
+		}
+		// PostgreSQL 15 allows scales larger than the precision, BigQuery doesn't
+		precision = max(precision, scale)
+		switch {
+		case scale <= bqNumericMaxScale && precision-scale <= bqNumericMaxIntegers:
+			return bigquery.NumericFieldType, precision, scale
+		case scale <= bqBigNumericMaxScale && precision-scale <= bqBigNumericMaxIntegers:
+			return bigquery.BigNumericFieldType, precision, scale
+		}
+	case "bool":
+		return bigquery.BooleanFieldType, 0, 0
+	case "bytea":
+		return bigquery.BytesFieldType, 0, 0
+	case "date":
+		return bigquery.DateFieldType, 0, 0
+	case "timestamp", "timestamptz":
+		return bigquery.TimestampFieldType, 0, 0
+	case "abstime":
+		return bigquery.DateTimeFieldType, 0, 0
+	case "jsonb":
+		return bigquery.JSONFieldType, 0, 0
+	}
+	return bigquery.StringFieldType, 0, 0
+}
+
 func updateTableAddColumn(projectID, datasetID, tableID string) error {
 	ctx := context.Background()
 	client, err := bigquery.NewClient(ctx, projectID)
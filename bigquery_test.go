@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestBQFieldType(t *testing.T) {
+	p := func(v int64) *int64 { return &v }
+	tests := []struct {
+		name      string
+		column    schemaColumn
+		fieldType bigquery.FieldType
+		precision int64
+		scale     int64
+	}{
+		{"float4", schemaColumn{UDTName: "float4"}, bigquery.FloatFieldType, 0, 0},
+		{"float8", schemaColumn{UDTName: "float8"}, bigquery.FloatFieldType, 0, 0},
+		{"int8", schemaColumn{UDTName: "int8"}, bigquery.IntegerFieldType, 0, 0},
+		{"numeric unconstrained", schemaColumn{UDTName: "numeric"}, bigquery.BigNumericFieldType, 0, 0},
+		{"numeric zero precision", schemaColumn{UDTName: "numeric", Precision: p(0)}, bigquery.BigNumericFieldType, 0, 0},
+		{"numeric(10,2)", schemaColumn{UDTName: "numeric", Precision: p(10), Scale: p(2)}, bigquery.NumericFieldType, 10, 2},
+		{"numeric(10) without scale", schemaColumn{UDTName: "numeric", Precision: p(10)}, bigquery.NumericFieldType, 10, 0},
+		{"numeric max", schemaColumn{UDTName: "numeric", Precision: p(38), Scale: p(9)}, bigquery.NumericFieldType, 38, 9},
+		{"numeric too many integer digits", schemaColumn{UDTName: "numeric", Precision: p(39), Scale: p(9)}, bigquery.BigNumericFieldType, 39, 9},
+		{"numeric too large a scale", schemaColumn{UDTName: "numeric", Precision: p(20), Scale: p(10)}, bigquery.BigNumericFieldType, 20, 10},
+		{"bignumeric max", schemaColumn{UDTName: "numeric", Precision: p(76), Scale: p(38)}, bigquery.BigNumericFieldType, 76, 38},
+		{"bignumeric too many integer digits", schemaColumn{UDTName: "numeric", Precision: p(77), Scale: p(38)}, bigquery.StringFieldType, 0, 0},
+		{"bignumeric too large a scale", schemaColumn{UDTName: "numeric", Precision: p(50), Scale: p(39)}, bigquery.StringFieldType, 0, 0},
+		{"negative scale", schemaColumn{UDTName: "numeric", Precision: p(5), Scale: p(-3)}, bigquery.NumericFieldType, 8, 0},
+		{"negative scale bignumeric", schemaColumn{UDTName: "numeric", Precision: p(25), Scale: p(-5)}, bigquery.BigNumericFieldType, 30, 0},
+		{"negative scale string", schemaColumn{UDTName: "numeric", Precision: p(30), Scale: p(-10)}, bigquery.StringFieldType, 0, 0},
+		{"scale larger than precision", schemaColumn{UDTName: "numeric", Precision: p(3), Scale: p(5)}, bigquery.NumericFieldType, 5, 5},
+		{"scale larger than precision bignumeric", schemaColumn{UDTName: "numeric", Precision: p(5), Scale: p(12)}, bigquery.BigNumericFieldType, 12, 12},
+		{"int4 array", schemaColumn{UDTName: "_int4", DataType: "ARRAY"}, bigquery.IntegerFieldType, 0, 0},
+		{"float8 array", schemaColumn{UDTName: "_float8", DataType: "ARRAY"}, bigquery.FloatFieldType, 0, 0},
+		{"numeric array", schemaColumn{UDTName: "_numeric", DataType: "ARRAY"}, bigquery.BigNumericFieldType, 0, 0},
+		{"text array", schemaColumn{UDTName: "_text", DataType: "ARRAY"}, bigquery.StringFieldType, 0, 0},
+		{"timestamptz array", schemaColumn{UDTName: "_timestamptz", DataType: "ARRAY"}, bigquery.TimestampFieldType, 0, 0},
+		{"vector", schemaColumn{UDTName: "vector", DataType: "USER-DEFINED"}, bigquery.FloatFieldType, 0, 0},
+		{"type mapping", schemaColumn{UDTName: "geometry", BQType: "GEOGRAPHY"}, bigquery.GeographyFieldType, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fieldType, precision, scale := bqFieldType(tt.column)
+			if fieldType != tt.fieldType || precision != tt.precision || scale != tt.scale {
+				t.Errorf("bqFieldType(%+v) = %v(%v,%v), want %v(%v,%v)", tt.column, fieldType, precision, scale, tt.fieldType, tt.precision, tt.scale)
+			}
+		})
+	}
+}
+
+func TestPGSchemaToBQSchemaArrays(t *testing.T) {
+	tableSchema := `{"columns": [
+		{"column_name": "id", "udt_name": "int8", "data_type": "bigint"},
+		{"column_name": "tags", "udt_name": "_text", "data_type": "ARRAY"},
+		{"column_name": "embedding", "udt_name": "vector", "data_type": "USER-DEFINED"}
+	]}`
+	_, schema, err := pgSchemaToBqSchema(tableSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"id": false, "tags": true, "embedding": true, "snapshot_tm": false}
+	if len(schema) != len(want) {
+		t.Fatalf("got %v fields, want %v", len(schema), len(want))
+	}
+	for _, field := range schema {
+		if field.Repeated != want[field.Name] {
+			t.Errorf("field %v repeated = %v, want %v", field.Name, field.Repeated, want[field.Name])
+		}
+	}
+}
@@ -13,43 +13,85 @@ import (
 	"github.com/spf13/cast"
 )
 
-func cdc() error {
+// cdc captures the next window of every table in due, in order, or of every
+// seeded table when due is nil.
+func cdc(due []int) error {
 	var err error
 	dsnCount := cast.ToInt64(os.Getenv("PG_DSN_COUNT"))
 	if dsnCount < 1 {
 		return fmt.Errorf("missing or invalid env var: pg_dsn_count")
 	}
+	// the cycle's queries and sink schemas are built from the same rules
+	rules, err := loadUserRules()
+	if err != nil {
+		return fmt.Errorf("cdc loaduserrules error: %v", err)
+	}
 
 	for i := 1; i <= int(dsnCount); i++ {
 		var dsnEnum int64 = int64(i)
 		var nmsColumn string
 		dbURL := os.Getenv("PG_DB_URL_" + cast.ToString(dsnEnum))
 		nmsColumn = os.Getenv("PG_NMS_COLUMN_" + cast.ToString(dsnEnum))
-		log.Printf("seed loop: %v\tdsnEnum %v\tdbURL %v\tnmsColumn %v\n", i, dsnEnum, dbURL, nmsColumn)
-		pgPool, err := getPGConnection(dbURL)
-		if err != nil {
-			return fmt.Errorf("pg connection failure: %v", err)
-		} else {
-			log.Println("PG Connected")
-		}
 		nmsDB, err := nmsDBOpen()
 		if err != nil {
 			return fmt.Errorf("cdc nmsdbopen error: %v", err)
 		}
 		tables, err := nmsTablesQuery(nmsDB, false)
 		if err != nil {
+			nmsDB.Close()
 			return fmt.Errorf("cdc nmstablesquery error: %v", err)
 		}
+		tables = withRules(sourceTables(scheduledTables(tables, due), dsnEnum), rules)
+		// sources without a due table aren't connected to
+		if len(tables) == 0 {
+			nmsDB.Close()
+			continue
+		}
+		log.Printf("seed loop: %v\tdsnEnum %v\tdbURL %v\tnmsColumn %v\n", i, dsnEnum, dbURL, nmsColumn)
+		pgPool, err := getPGConnection(dbURL)
+		if err != nil {
+			nmsDB.Close()
+			return fmt.Errorf("pg connection failure: %v", err)
+		} else {
+			log.Println("PG Connected")
+		}
 		batchCount := cast.ToFloat64(os.Getenv("BQ_BATCH_COUNT"))
 		if batchCount == 0.0 {
 			batchCount = 4096
 		}
 		replicationBufferSecs := cast.ToInt64(os.Getenv("PG_REPLICATION_BUFFER_SECS"))
+		isReplica := cast.ToBool(os.Getenv("PG_DB_IS_REPLICA_" + cast.ToString(dsnEnum)))
+
+		clock, err := getSourceClock(pgPool)
+		if err != nil {
+			return fmt.Errorf("cdc getsourceclock error: %v", err)
+		}
+		var replicaMargin time.Duration
+		if isReplica {
+			lag := clock.replicaLag()
+			setGauge("leftshove_replica_lag_seconds", `dsn="`+cast.ToString(dsnEnum)+`"`, lag.Seconds())
+			log.Printf("cdc: dsn %v replica lag %v\n", dsnEnum, lag.Round(time.Millisecond))
+			maxLagSecs := cast.ToInt64(os.Getenv("PG_REPLICA_MAX_LAG_SECS_" + cast.ToString(dsnEnum)))
+			if maxLagSecs > 0 && lag > time.Second*time.Duration(maxLagSecs) {
+				log.Printf("cdc: dsn %v replica lag %v exceeds %vs, skipping cycle\n", dsnEnum, lag.Round(time.Second), maxLagSecs)
+				nmsDB.Close()
+				pgPool.Close()
+				continue
+			}
+			replicaMargin = time.Second * time.Duration(cast.ToInt64(os.Getenv("PG_REPLICA_LAG_MARGIN_SECS_"+cast.ToString(dsnEnum))))
+		}
+		var snap *pgSnapshot
+		if cast.ToBool(os.Getenv("PG_CONSISTENT_SNAPSHOT_"+cast.ToString(dsnEnum))) && len(tables) > 0 {
+			snap, err = exportPGSnapshot(pgPool)
+			if err != nil {
+				return fmt.Errorf("cdc exportpgsnapshot error: %v", err)
+			}
+		}
 
 		for i, t := range tables {
 			var currentRowCount int64
 			if t.DSNEnum == dsnEnum {
-				currentRowCount, err = getTableRowCount(t.Name, pgPool)
+				currentRowCount, err = getTableRowCount(t.Schema, t.Name, pgPool)
 				if err != nil {
 					log.Printf("cdc gettablerowcount error: %v", err)
 					continue
@@ -57,10 +99,25 @@ func cdc() error {
 			} else {
 				continue
 			}
+			err = refreshTypeKeys(&tables[i], pgPool, nmsDB)
+			if err != nil {
+				log.Printf("cdc refreshtypekeys error: %v", err)
+				continue
+			}
+			t.TableSchema = tables[i].TableSchema
 
 			rowDiff := math.Abs(cast.ToFloat64(currentRowCount - t.LastRowCount))
 
-			currentTime := time.Now()
+			currentTime := clock.now
+			if snap != nil {
+				currentTime = snap.now.In(clock.location)
+			}
+			// a replica only holds rows up to its last replayed transaction
+			if isReplica && clock.replicaUpperBound(replicaMargin).Before(currentTime) {
+				currentTime = clock.replicaUpperBound(replicaMargin)
+			}
+			nmsType := nmsColumnType(t)
+			t.NMS = clock.sourceTime(t.NMS, nmsType)
 			diff := currentTime.Sub(t.NMS)
 			lastShoveDiff := currentTime.Sub(t.LastShove)
 			switch {
@@ -95,18 +152,30 @@ func cdc() error {
 
 			}
 
-			newNMS := t.NewNMS.Format("2006-01-02 15:04:05")
-			tables[i].Query, err = getTableNMSQuery(t.Schema, t.Name, t.NMSColumn, t.NMS.Format("2006-01-02 15:04:05"), newNMS, pgPool)
+			newNMS := formatNMS(t.NewNMS, nmsType)
+			// re-read the end of the previous window to catch rows committed after it closed
+			windowStart := formatNMS(t.NMS.Add(-lookbackDuration(t)), nmsType)
+			// a snapshot import is a multi-statement query, which cannot take bind parameters
+			args := &queryArgs{inline: snap != nil}
+			tables[i].Query, err = getTableNMSQuery(t, windowStart, newNMS, args, pgPool)
 			if err != nil {
 				log.Printf("cdc gettablenmsquery error: %v", err)
 				continue
 			}
+			if snap != nil {
+				tables[i].Query = snapshotQuery(snap.id, tables[i].Query)
+			}
+			tables[i].QueryArgs = args.values
 			tables[i].NewNMS = t.NewNMS
+			tables[i].capturedFrom = clock.now
 		}
 		for i := range tables {
 			if tables[i].Query != "" {
 				tables[i].stream, err = newStream(dbURL, tables[i])
 				if err != nil {
+					if snap != nil {
+						snap.close()
+					}
 					return fmt.Errorf("cdc newstream error: %v", err)
 				}
 			}
@@ -124,22 +193,80 @@ func cdc() error {
 				go func() {
 					log.Printf("stream table %v.%v\n", tables[i].DSNEnum, tables[i].Name)
 					defer wg.Done()
-					err = tables[i].stream.Run(context.Background())
+					err := tables[i].stream.Run(context.Background())
+					sanitized := sanitizedValues(tables[i])
 					if err != nil {
+						discardPending(tables[i])
 						log.Printf("stream failure: %v.%v - %v", tables[i].DSNEnum, tables[i].Name, err)
 						return
 					}
+					err = publishWindow(&tables[i])
+					if err != nil {
+						discardPending(tables[i])
+						log.Printf("window publish failure: %v.%v - %v", tables[i].DSNEnum, tables[i].Name, err)
+						return
+					}
 					err = updateNMS(tables[i], nmsDB)
 					if err != nil {
+						discardPending(tables[i])
 						log.Printf("nms update error: id:%v - %v", tables[i].ID, err)
 						return
 					}
+					if len(sanitized) > 0 {
+						log.Printf("sanitized values: %v.%v - %v", tables[i].DSNEnum, tables[i].Name, sanitized)
+					}
+					err = insertRun(tables[i], sanitized, nmsDB)
+					if err != nil {
+						log.Printf("run history insert error: id:%v - %v", tables[i].ID, err)
+					}
+					commitDelivered(tables[i], lookbackDuration(tables[i]))
+					runRecaptures(dbURL, tables[i], pgPool, nmsDB)
 				}()
 			}
 		}
 		wg.Wait()
+		if snap != nil {
+			snap.close()
+		}
 		nmsDB.Close()
 		pgPool.Close()
 	}
 	return err
 }
+
+// publishWindow runs the steps completing t's window once its stream has run:
+// the BigQuery current table merge, the avro encoding check and the Iceberg
+// snapshot commit.
+func publishWindow(t *table) error {
+	var err error
+	if os.Getenv("OUTPUT_TYPE") == "BQ" && currentTableEnabled(*t) {
+		err = mergeBigQueryCurrentTable(*t)
+		if err != nil {
+			return fmt.Errorf("current table merge error: %v", err)
+		}
+	}
+	err = avroEncodingErrors(*t)
+	if err != nil {
+		return fmt.Errorf("avro encoding failure: %v", err)
+	}
+	if os.Getenv("OUTPUT_TYPE") == "ICEBERG" {
+		t.IcebergSnapshotID, err = commitIcebergWindow(*t)
+		if err != nil {
+			return fmt.Errorf("iceberg commit error: %v", err)
+		}
+	}
+	return nil
+}
+
+// lookbackDuration returns how far t's windows overlap the previous window,
+// recaptured windows don't overlap.
+func lookbackDuration(t table) time.Duration {
+	if t.recaptureID != 0 {
+		return 0
+	}
+	lookbackSecs := t.LookbackSecs
+	if lookbackSecs <= 0 {
+		lookbackSecs = cast.ToInt64(os.Getenv("PG_LOOKBACK_SECS_" + cast.ToString(t.DSNEnum)))
+	}
+	return time.Second * time.Duration(lookbackSecs)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/shopspring/decimal"
+	"github.com/spf13/cast"
+	sugar "github.com/waclawthedev/go-sugaring"
+)
+
+func init() {
+	spec := service.NewConfigSpec().
+		Summary("Inserts captured rows into a leftshove managed ClickHouse ReplacingMergeTree table.").
+		Field(service.NewStringField("dsn")).
+		Field(service.NewStringField("database")).
+		Field(service.NewStringField("table")).
+		Field(service.NewStringField("table_schema")).
+		Field(service.NewStringListField("pkey_columns").Default([]any{})).
+		Field(service.NewStringField("nms_column")).
+		Field(service.NewIntField("max_in_flight").Default(1)).
+		Field(service.NewBatchPolicyField("batching"))
+	err := service.RegisterBatchOutput("leftshove_clickhouse", spec, func(conf *service.ParsedConfig, mgr *service.Resources) (out service.BatchOutput, batchPolicy service.BatchPolicy, maxInFlight int, err error) {
+		var o clickHouseOutput
+		if o.dsn, err = conf.FieldString("dsn"); err != nil {
+			return
+		}
+		if o.database, err = conf.FieldString("database"); err != nil {
+			return
+		}
+		if o.table, err = conf.FieldString("table"); err != nil {
+			return
+		}
+		var tableSchema string
+		if tableSchema, err = conf.FieldString("table_schema"); err != nil {
+			return
+		}
+		var columns []schemaColumn
+		if columns, err = parseSchemaColumns(tableSchema); err != nil {
+			return
+		}
+		if o.pkeyColumns, err = conf.FieldStringList("pkey_columns"); err != nil {
+			return
+		}
+		if o.nmsColumn, err = conf.FieldString("nms_column"); err != nil {
+			return
+		}
+		for _, c := range columns {
+			// ORDER BY and version columns can't be Nullable
+			nullable := c.IsNullable != "NO" && c.Name != o.nmsColumn && !sugar.Contains(o.pkeyColumns, c.Name)
+			o.columns = append(o.columns, clickHouseColumn{name: c.Name, chType: clickHouseType(c), nullable: nullable})
+		}
+		o.columns = append(o.columns, clickHouseColumn{name: "snapshot_tm", chType: "DateTime64(6, 'UTC')", nullable: true})
+		if maxInFlight, err = conf.FieldInt("max_in_flight"); err != nil {
+			return
+		}
+		if batchPolicy, err = conf.FieldBatchPolicy("batching"); err != nil {
+			return
+		}
+		return &o, batchPolicy, maxInFlight, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// clickHouseType maps a PostgreSQL column to its ClickHouse type:
+//
+//	int2, int4, int8             Int16, Int32, Int64
+//	oid, xid                     UInt32
+//	float4, float8               Float32, Float64
+//	numeric(p,s), p <= 76        Decimal(p,s)
+//	numeric                      String, unconstrained numerics don't fit a Decimal
+//	bool                         Bool
+//	uuid                         UUID
+//	date                         Date32
+//	timestamp, timestamptz       DateTime64(6, 'UTC'), timestamp wall clock times are kept as is
+//	arrays, json, jsonb          String (JSON)
+//	anything else                String
+func clickHouseType(c schemaColumn) string {
+	if c.DataType == "ARRAY" {
+		return "String"
+	}
+	switch c.UDTName {
+	case "int2":
+		return "Int16"
+	case "int4":
+		return "Int32"
+	case "int8":
+		return "Int64"
+	case "oid", "xid":
+		return "UInt32"
+	case "float4":
+		return "Float32"
+	case "float8":
+		return "Float64"
+	case "numeric":
+		if c.Precision != nil && c.Scale != nil && *c.Precision > 0 && *c.Precision <= 76 {
+			return fmt.Sprintf("Decimal(%v, %v)", *c.Precision, *c.Scale)
+		}
+	case "bool":
+		return "Bool"
+	case "uuid":
+		return "UUID"
+	case "date":
+		return "Date32"
+	case "timestamp", "timestamptz":
+		return "DateTime64(6, 'UTC')"
+	}
+	return "String"
+}
+
+type clickHouseColumn struct {
+	name     string
+	chType   string
+	nullable bool
+}
+
+func (c clickHouseColumn) definition() string {
+	if c.nullable {
+		return clickHouseIdentifier(c.name) + " Nullable(" + c.chType + ")"
+	}
+	return clickHouseIdentifier(c.name) + " " + c.chType
+}
+
+// value converts a row value to the Go type the driver expects for the column.
+func (c clickHouseColumn) value(v any) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch {
+	case c.chType == "Int16":
+		return cast.ToInt16E(v)
+	case c.chType == "Int32":
+		return cast.ToInt32E(v)
+	case c.chType == "Int64":
+		return cast.ToInt64E(v)
+	case c.chType == "UInt32":
+		return cast.ToUint32E(v)
+	case c.chType == "Float32":
+		return cast.ToFloat32E(v)
+	case c.chType == "Float64":
+		return cast.ToFloat64E(v)
+	case c.chType == "Bool":
+		return cast.ToBoolE(v)
+	case strings.HasPrefix(c.chType, "Decimal"):
+		s, err := cast.ToStringE(v)
+		if err != nil {
+			return nil, err
+		}
+		return decimal.NewFromString(s)
+	case c.chType == "Date32", strings.HasPrefix(c.chType, "DateTime64"):
+		return rowTime(v)
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case map[string]any, []any:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+	return cast.ToStringE(v)
+}
+
+func clickHouseIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(strings.ReplaceAll(name, `\`, `\\`), "`", "\\`") + "`"
+}
+
+type clickHouseOutput struct {
+	dsn         string
+	database    string
+	table       string
+	columns     []clickHouseColumn
+	pkeyColumns []string
+	nmsColumn   string
+	conn        driver.Conn
+}
+
+func (o *clickHouseOutput) target() string {
+	return clickHouseIdentifier(o.database) + "." + clickHouseIdentifier(o.table)
+}
+
+// createStatement returns the sink table DDL. Rows are versioned by the nms
+// column, so merges keep the latest version of each primary key.
+func (o *clickHouseOutput) createStatement() string {
+	var definitions []string
+	for _, c := range o.columns {
+		definitions = append(definitions, c.definition())
+	}
+	engine := "ReplacingMergeTree(" + clickHouseIdentifier(o.nmsColumn) + ")"
+	orderBy := "tuple()"
+	if len(o.pkeyColumns) > 0 {
+		var pkeys []string
+		for _, column := range o.pkeyColumns {
+			pkeys = append(pkeys, clickHouseIdentifier(column))
+		}
+		orderBy = "(" + strings.Join(pkeys, ", ") + ")"
+	} else {
+		engine = "MergeTree"
+	}
+	return "CREATE TABLE IF NOT EXISTS " + o.target() + " (" + strings.Join(definitions, ", ") + ") ENGINE = " + engine + " ORDER BY " + orderBy
+}
+
+// Connect creates the sink database and table if they don't exist.
+func (o *clickHouseOutput) Connect(ctx context.Context) error {
+	opts, err := clickhouse.ParseDSN(o.dsn)
+	if err != nil {
+		return fmt.Errorf("clickhouse dsn parse error: %v", err)
+	}
+	conn, err := clickhouse.Open(opts)
+	if err != nil {
+		return fmt.Errorf("clickhouse connect error: %v", err)
+	}
+	err = conn.Exec(ctx, "CREATE DATABASE IF NOT EXISTS "+clickHouseIdentifier(o.database))
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("clickhouse create database error: %v", err)
+	}
+	err = conn.Exec(ctx, o.createStatement())
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("clickhouse create table error: %v", err)
+	}
+	o.conn = conn
+	return nil
+}
+
+// WriteBatch sends the batch's rows in a single native insert block.
+func (o *clickHouseOutput) WriteBatch(ctx context.Context, batch service.MessageBatch) error {
+	if o.conn == nil {
+		return service.ErrNotConnected
+	}
+	var columns []string
+	for _, c := range o.columns {
+		columns = append(columns, clickHouseIdentifier(c.name))
+	}
+	insert, err := o.conn.PrepareBatch(ctx, "INSERT INTO "+o.target()+" ("+strings.Join(columns, ", ")+")")
+	if err != nil {
+		return fmt.Errorf("clickhouse prepare batch error: %v", err)
+	}
+	for _, msg := range batch {
+		structured, err := msg.AsStructured()
+		if err != nil {
+			return fmt.Errorf("clickhouse message read error: %v", err)
+		}
+		row, ok := structured.(map[string]any)
+		if !ok {
+			return fmt.Errorf("clickhouse message is not an object: %T", structured)
+		}
+		var values []any
+		for _, c := range o.columns {
+			v, err := c.value(row[c.name])
+			if err != nil {
+				return fmt.Errorf("clickhouse column %v value error: %v", c.name, err)
+			}
+			values = append(values, v)
+		}
+		err = insert.Append(values...)
+		if err != nil {
+			return fmt.Errorf("clickhouse batch append error: %v", err)
+		}
+	}
+	err = insert.Send()
+	if err != nil {
+		return fmt.Errorf("clickhouse batch send error: %v", err)
+	}
+	return nil
+}
+
+func (o *clickHouseOutput) Close(ctx context.Context) error {
+	if o.conn != nil {
+		return o.conn.Close()
+	}
+	return nil
+}
+
+// clickHouseDatabase returns the sink database of t, CH_DATABASE_N or its source schema.
+func clickHouseDatabase(t table) string {
+	if database := os.Getenv("CH_DATABASE_" + cast.ToString(t.DSNEnum)); database != "" {
+		return database
+	}
+	return t.Schema
+}
+
+// newClickHouseStreamConfig returns the leftshove_clickhouse output inserting
+// t's rows into its current state table in CH_URL.
+func newClickHouseStreamConfig(t table) (string, error) {
+	chURL := os.Getenv("CH_URL")
+	if chURL == "" {
+		return "", fmt.Errorf("missing env var: ch_url")
+	}
+	tableSchema, err := sinkTableSchema(t)
+	if err != nil {
+		return "", err
+	}
+	pkeys, err := json.Marshal(t.PKeyColumns)
+	if err != nil {
+		return "", fmt.Errorf("pkey columns marshal error: %v", err)
+	}
+	batchCount := os.Getenv("CH_BATCH_COUNT")
+	if batchCount == "" {
+		batchCount = cast.ToString(100000)
+	}
+	batchPeriod := os.Getenv("CH_BATCH_PERIOD")
+	if batchPeriod == "" {
+		batchPeriod = "10s"
+	}
+	outputYAML := `leftshove_clickhouse:
+  dsn: {dsn}
+  database: {database}
+  table: {table}
+  table_schema: {tableSchema}
+  pkey_columns: {pkeys}
+  nms_column: {nmsColumn}
+  batching:
+    count: {batchCount}
+    period: "{batchPeriod}"`
+	outputConf := strings.NewReplacer(
+		"{dsn}", yamlString(chURL),
+		"{database}", yamlString(clickHouseDatabase(t)),
+		"{table}", yamlString(sinkStateTableName(t)),
+		"{tableSchema}", yamlString(tableSchema),
+		"{pkeys}", string(pkeys),
+		"{nmsColumn}", yamlString(t.NMSColumn),
+		"{batchCount}", batchCount,
+		"{batchPeriod}", batchPeriod,
+	).Replace(outputYAML)
+	return outputConf, nil
+}
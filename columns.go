@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/cast"
+	sugar "github.com/waclawthedev/go-sugaring"
+)
+
+// columnRule applies Action to the columns matching its source, schema, table
+// and column globs. Empty matchers match everything. Actions are:
+//   - include: keep only the columns matched by the table's include rules
+//   - drop: leave the column out of the capture
+//   - hash: replace the value with its hex HMAC-SHA256 keyed by COLUMN_HASH_KEY (requires pgcrypto on the source)
+//   - truncate: keep the first Length characters of the value as text
+//   - null: replace the value with NULL
+type columnRule struct {
+	DSN    int64  `json:"dsn"`
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	Action string `json:"action"`
+	Length int    `json:"length"`
+}
+
+// loadColumnRules reads the rules of the COLUMN_RULES_FILE JSON array.
+func loadColumnRules() ([]columnRule, error) {
+	var rules []columnRule
+	rulesFile := os.Getenv("COLUMN_RULES_FILE")
+	if rulesFile == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(rulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("column rules file read error: %v", err)
+	}
+	err = json.Unmarshal(b, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("column rules file parse error: %v", err)
+	}
+	for _, r := range rules {
+		switch r.Action {
+		case "include", "drop", "hash", "null":
+		case "truncate":
+			if r.Length < 1 {
+				return nil, fmt.Errorf("column rule %+v: truncate requires a length", r)
+			}
+		default:
+			return nil, fmt.Errorf("column rule %+v: unknown action %q", r, r.Action)
+		}
+	}
+	return rules, nil
+}
+
+// userRules are the column rules, type mappings and sanitize rules of a
+// capture cycle, read once so that its queries and sink schemas agree.
+type userRules struct {
+	columns  []columnRule
+	mappings []typeMapping
+	sanitize []sanitizeRule
+}
+
+// loadUserRules reads the COLUMN_RULES_FILE, TYPE_MAPPINGS_FILE and
+// SANITIZE_RULES_FILE rules.
+func loadUserRules() (*userRules, error) {
+	var rules userRules
+	var err error
+	rules.columns, err = loadColumnRules()
+	if err != nil {
+		return nil, err
+	}
+	rules.mappings, err = loadTypeMappings()
+	if err != nil {
+		return nil, err
+	}
+	rules.sanitize, err = loadSanitizeRules()
+	if err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+// tableRules returns the user rules t is captured with, read from the rule
+// files if t wasn't given the rules of a cycle.
+func tableRules(t table) (*userRules, error) {
+	if t.rules != nil {
+		return t.rules, nil
+	}
+	return loadUserRules()
+}
+
+// withRules returns tables, each given rules.
+func withRules(tables []table, rules *userRules) []table {
+	for i := range tables {
+		tables[i].rules = rules
+	}
+	return tables
+}
+
+func globMatch(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, s)
+	return matched
+}
+
+func (r columnRule) matchesTable(t table) bool {
+	return (r.DSN == 0 || r.DSN == t.DSNEnum) && globMatch(r.Schema, t.Schema) && globMatch(r.Table, t.Name)
+}
+
+// columnAction returns the rule applied to t's column, with an empty Action if
+// the column is captured as is. The nms and primary key columns are never
+// dropped or nulled, windows and deduplication depend on them.
+func columnAction(rules []columnRule, t table, column string) columnRule {
+	var action columnRule
+	var hasInclude, included bool
+	for _, r := range rules {
+		if !r.matchesTable(t) {
+			continue
+		}
+		if r.Action == "include" {
+			hasInclude = true
+			included = included || globMatch(r.Column, column)
+			continue
+		}
+		if action.Action == "" && globMatch(r.Column, column) {
+			action = r
+		}
+	}
+	if hasInclude && !included && action.Action == "" {
+		action = columnRule{Action: "drop"}
+	}
+	if (action.Action == "drop" || action.Action == "null") && (column == t.NMSColumn || sugar.Contains(t.PKeyColumns, column)) {
+		log.Printf("columnAction: ignoring %v rule for key column %v.%v.%v\n", action.Action, t.Schema, t.Name, column)
+		return columnRule{}
+	}
+	return action
+}
+
+// columnExpression returns the select list expression capturing a column
+// under action, or "" if the column is dropped.
+func columnExpression(c pgColumn, action columnRule, args *queryArgs) (string, error) {
+	ident := pgx.Identifier{c.name}.Sanitize()
+	switch action.Action {
+	case "drop":
+		return "", nil
+	case "hash":
+		key := os.Getenv("COLUMN_HASH_KEY")
+		if key == "" {
+			return "", fmt.Errorf("missing env var: column_hash_key")
+		}
+		return "encode(hmac(" + ident + "::text, " + args.add(key) + ", 'sha256'), 'hex') AS " + ident, nil
+	case "truncate":
+		return "left(" + ident + "::text, " + strconv.Itoa(action.Length) + ") AS " + ident, nil
+	case "null":
+		// keeps the column's type, unlike a bare NULL
+		return "CASE WHEN false THEN " + ident + " END AS " + ident, nil
+	}
+	return "", nil
+}
+
+// sinkTableSchema returns t's cached table_schema with the columns dropped by
+// the column rules removed, the type of hashed and truncated columns set to
+// text and the type mappings applied, the schema sinks receive.
+func sinkTableSchema(t table) (string, error) {
+	userRules, err := tableRules(t)
+	if err != nil {
+		return "", err
+	}
+	rules, mappings := userRules.columns, userRules.mappings
+	if len(rules) == 0 && len(mappings) == 0 {
+		return t.TableSchema, nil
+	}
+	if len(mappings) > 0 {
+		stale, err := staleTypeKeys(t.TableSchema)
+		if err != nil {
+			return "", fmt.Errorf("sinktableschema() %v", err)
+		}
+		if stale {
+			return "", fmt.Errorf("sinktableschema() %v.%v was seeded before type mappings, re-seed it or run -cdc to refresh its cached schema", t.Schema, t.Name)
+		}
+	}
+	var tableSchema map[string]any
+	err = json.Unmarshal([]byte(t.TableSchema), &tableSchema)
+	if err != nil {
+		return "", fmt.Errorf("sinktableschema() tableschema parsejson: %v", err)
+	}
+	columns, _ := tableSchema["columns"].([]any)
+	var kept []any
+	for _, c := range columns {
+		column, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		name, _ := column["column_name"].(string)
+		switch columnAction(rules, t, name).Action {
+		case "drop":
+			continue
+		case "hash", "truncate":
+			column["udt_name"] = "text"
+			column["data_type"] = "text"
+			column["numeric_precision"] = nil
+			column["numeric_scale"] = nil
+		default:
+			udtName, _ := column["udt_name"].(string)
+			domainName, _ := column["domain_name"].(string)
+			isEnum, _ := column["is_enum"].(bool)
+			columnTypeMapping(mappings, t, name, udtName, domainName, isEnum).apply(column)
+		}
+		kept = append(kept, column)
+	}
+	tableSchema["columns"] = kept
+	b, err := json.Marshal(tableSchema)
+	if err != nil {
+		return "", fmt.Errorf("sinktableschema() marshal: %v", err)
+	}
+	return string(b), nil
+}
+
+// schemaColumn is a column of a cached table_schema, from the source's
+// information_schema.columns.
+type schemaColumn struct {
+	Name       string `json:"column_name"`
+	UDTName    string `json:"udt_name"`
+	DataType   string `json:"data_type"`
+	IsNullable string `json:"is_nullable"`
+	MaxLength  *int64 `json:"character_maximum_length"`
+	Precision  *int64 `json:"numeric_precision"`
+	Scale      *int64 `json:"numeric_scale"`
+	DomainName string `json:"domain_name"`
+	IsEnum     bool   `json:"is_enum"`
+	// BQType is the BigQuery type set by a type mapping.
+	BQType string `json:"bq_type"`
+	// typeOverride replaces the column's type in the PostgreSQL sink.
+	typeOverride string
+}
+
+func parseSchemaColumns(tableSchema string) ([]schemaColumn, error) {
+	var schema struct {
+		Columns []schemaColumn `json:"columns"`
+	}
+	err := json.Unmarshal([]byte(tableSchema), &schema)
+	if err != nil {
+		return nil, fmt.Errorf("tableschema parsejson: %v", err)
+	}
+	return schema.Columns, nil
+}
+
+// rowTime converts a row's date or timestamp value to a time.Time, values
+// turned to PostgreSQL text output, ie. by a user processor, are parsed too.
+func rowTime(v any) (time.Time, error) {
+	if s, ok := v.(string); ok {
+		for _, layout := range []string{"2006-01-02 15:04:05.999999999-07", "2006-01-02 15:04:05.999999999-07:00", "2006-01-02 15:04:05.999999999"} {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return cast.ToTimeE(v)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/spf13/cast"
+)
+
+// deliveredKeys remembers the primary key + nms value of rows delivered by
+// recent windows of each table, so that rows re-read by the lookback overlap
+// of the next window can be dropped. Keys seen by a window stay pending until
+// the window's nms is committed, so a failed window never suppresses its retry.
+var deliveredKeys = struct {
+	sync.Mutex
+	delivered map[string]map[string]time.Time
+	pending   map[string]map[string]bool
+}{
+	delivered: make(map[string]map[string]time.Time),
+	pending:   make(map[string]map[string]bool),
+}
+
+func init() {
+	spec := service.NewConfigSpec().
+		Summary("Deduplicates rows re-read by overlapping leftshove capture windows.").
+		Field(service.NewStringField("table"))
+	err := service.RegisterCache("leftshove_delivered", spec, func(conf *service.ParsedConfig, mgr *service.Resources) (service.Cache, error) {
+		tableKey, err := conf.FieldString("table")
+		if err != nil {
+			return nil, err
+		}
+		return &deliveredCache{tableKey: tableKey}, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+type deliveredCache struct {
+	tableKey string
+}
+
+func (c *deliveredCache) Get(ctx context.Context, key string) ([]byte, error) {
+	deliveredKeys.Lock()
+	defer deliveredKeys.Unlock()
+	if _, ok := deliveredKeys.delivered[c.tableKey][key]; ok {
+		return []byte{'t'}, nil
+	}
+	return nil, service.ErrKeyNotFound
+}
+
+func (c *deliveredCache) Set(ctx context.Context, key string, value []byte, ttl *time.Duration) error {
+	deliveredKeys.Lock()
+	defer deliveredKeys.Unlock()
+	if deliveredKeys.pending[c.tableKey] == nil {
+		deliveredKeys.pending[c.tableKey] = make(map[string]bool)
+	}
+	deliveredKeys.pending[c.tableKey][key] = true
+	return nil
+}
+
+func (c *deliveredCache) Add(ctx context.Context, key string, value []byte, ttl *time.Duration) error {
+	if _, err := c.Get(ctx, key); err == nil {
+		return service.ErrKeyAlreadyExists
+	}
+	return c.Set(ctx, key, value, ttl)
+}
+
+func (c *deliveredCache) Delete(ctx context.Context, key string) error {
+	deliveredKeys.Lock()
+	defer deliveredKeys.Unlock()
+	delete(deliveredKeys.pending[c.tableKey], key)
+	return nil
+}
+
+func (c *deliveredCache) Close(ctx context.Context) error {
+	return nil
+}
+
+// commitDelivered records the rows of t's successful window as delivered and
+// forgets rows the next window's overlap can no longer re-read.
+func commitDelivered(t table, lookback time.Duration) {
+	tableKey := deliveredTableKey(t)
+	deliveredKeys.Lock()
+	defer deliveredKeys.Unlock()
+	if deliveredKeys.delivered[tableKey] == nil {
+		deliveredKeys.delivered[tableKey] = make(map[string]time.Time)
+	}
+	delivered := deliveredKeys.delivered[tableKey]
+	for key := range deliveredKeys.pending[tableKey] {
+		delivered[key] = t.NewNMS
+	}
+	delete(deliveredKeys.pending, tableKey)
+	lowerBound := t.NewNMS.Add(-lookback)
+	for key, windowEnd := range delivered {
+		if !windowEnd.After(lowerBound) {
+			delete(delivered, key)
+		}
+	}
+}
+
+// discardPending forgets the rows seen by t's failed window.
+func discardPending(t table) {
+	deliveredKeys.Lock()
+	defer deliveredKeys.Unlock()
+	delete(deliveredKeys.pending, deliveredTableKey(t))
+}
+
+func deliveredTableKey(t table) string {
+	if t.recaptureID != 0 {
+		return cast.ToString(t.ID) + "-recapture-" + cast.ToString(t.recaptureID)
+	}
+	return cast.ToString(t.ID)
+}
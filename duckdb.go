@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+// duckDBType maps a PostgreSQL column to its DuckDB type. Arrays, json and
+// types DuckDB has no equivalent for are stored as VARCHAR.
+func duckDBType(c schemaColumn) string {
+	if c.DataType == "ARRAY" {
+		return "VARCHAR"
+	}
+	switch c.UDTName {
+	case "int2":
+		return "SMALLINT"
+	case "int4":
+		return "INTEGER"
+	case "int8":
+		return "BIGINT"
+	case "oid", "xid":
+		return "UINTEGER"
+	case "float4":
+		return "REAL"
+	case "float8":
+		return "DOUBLE"
+	case "numeric":
+		if c.Precision != nil && c.Scale != nil && *c.Precision > 0 && *c.Precision <= 38 {
+			return fmt.Sprintf("DECIMAL(%v,%v)", *c.Precision, *c.Scale)
+		}
+	case "bool":
+		return "BOOLEAN"
+	case "uuid":
+		return "UUID"
+	case "date":
+		return "DATE"
+	case "time":
+		return "TIME"
+	case "timestamp":
+		return "TIMESTAMP"
+	case "timestamptz":
+		return "TIMESTAMPTZ"
+	}
+	return "VARCHAR"
+}
+
+// duckDBSchema returns the DuckDB schema of t, DUCKDB_SCHEMA_N or its source schema.
+func duckDBSchema(t table) string {
+	if schema := os.Getenv("DUCKDB_SCHEMA_" + cast.ToString(t.DSNEnum)); schema != "" {
+		return schema
+	}
+	return t.Schema
+}
+
+func duckDBPath() string {
+	if path := os.Getenv("DUCKDB_PATH"); path != "" {
+		return path
+	}
+	return "./output/leftshove.duckdb"
+}
+
+// duckDBViewName returns the name of t's latest-row view, or an empty string
+// for a staging table, which must not replace the live table's view.
+func duckDBViewName(t table) string {
+	if t.stagingTable != "" {
+		return ""
+	}
+	return sinkViewName(t)
+}
+
+// newDuckDBStreamConfig returns the leftshove_duckdb output appending t's rows
+// to its sink table in the DUCKDB_PATH database file.
+func newDuckDBStreamConfig(t table) (string, error) {
+	if !duckDBSupported {
+		return "", fmt.Errorf("duckdb output requires a build with cgo and -tags duckdb")
+	}
+	path := duckDBPath()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", fmt.Errorf("duckdb directory create error: %v", err)
+	}
+	tableSchema, err := sinkTableSchema(t)
+	if err != nil {
+		return "", err
+	}
+	pkeys, err := json.Marshal(t.PKeyColumns)
+	if err != nil {
+		return "", fmt.Errorf("pkey columns marshal error: %v", err)
+	}
+	outputYAML := `leftshove_duckdb:
+  path: {path}
+  schema: {schema}
+  table: {table}
+  view: {view}
+  table_schema: {tableSchema}
+  pkey_columns: {pkeys}
+  nms_column: {nmsColumn}
+  batching:
+    count: 10000
+    period: "1s"`
+	outputConf := strings.NewReplacer(
+		"{path}", yamlString(path),
+		"{schema}", yamlString(duckDBSchema(t)),
+		"{table}", yamlString(sinkTableName(t)),
+		"{view}", yamlString(duckDBViewName(t)),
+		"{tableSchema}", yamlString(tableSchema),
+		"{pkeys}", string(pkeys),
+		"{nmsColumn}", yamlString(t.NMSColumn),
+	).Replace(outputYAML)
+	return outputConf, nil
+}
@@ -0,0 +1,229 @@
+//go:build duckdb
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/jackc/pgx/v5"
+	_ "github.com/marcboeker/go-duckdb"
+	"github.com/spf13/cast"
+)
+
+const duckDBSupported = true
+
+// duckDBFiles shares one connection pool per database file between streams, a
+// DuckDB file can only be opened once per process.
+var duckDBFiles = struct {
+	sync.Mutex
+	dbs  map[string]*sql.DB
+	refs map[string]int
+}{
+	dbs:  make(map[string]*sql.DB),
+	refs: make(map[string]int),
+}
+
+func duckDBOpen(path string) (*sql.DB, error) {
+	duckDBFiles.Lock()
+	defer duckDBFiles.Unlock()
+	if db, ok := duckDBFiles.dbs[path]; ok {
+		duckDBFiles.refs[path]++
+		return db, nil
+	}
+	db, err := sql.Open("duckdb", path)
+	if err != nil {
+		return nil, err
+	}
+	duckDBFiles.dbs[path] = db
+	duckDBFiles.refs[path] = 1
+	return db, nil
+}
+
+func duckDBRelease(path string) error {
+	duckDBFiles.Lock()
+	defer duckDBFiles.Unlock()
+	duckDBFiles.refs[path]--
+	if duckDBFiles.refs[path] > 0 {
+		return nil
+	}
+	db := duckDBFiles.dbs[path]
+	delete(duckDBFiles.dbs, path)
+	delete(duckDBFiles.refs, path)
+	return db.Close()
+}
+
+func init() {
+	spec := service.NewConfigSpec().
+		Summary("Appends captured rows to a leftshove managed DuckDB table.").
+		Field(service.NewStringField("path")).
+		Field(service.NewStringField("schema")).
+		Field(service.NewStringField("table")).
+		Field(service.NewStringField("view")).
+		Field(service.NewStringField("table_schema")).
+		Field(service.NewStringListField("pkey_columns").Default([]any{})).
+		Field(service.NewStringField("nms_column")).
+		Field(service.NewBatchPolicyField("batching"))
+	err := service.RegisterBatchOutput("leftshove_duckdb", spec, func(conf *service.ParsedConfig, mgr *service.Resources) (out service.BatchOutput, batchPolicy service.BatchPolicy, maxInFlight int, err error) {
+		var o duckDBOutput
+		if o.path, err = conf.FieldString("path"); err != nil {
+			return
+		}
+		if o.schema, err = conf.FieldString("schema"); err != nil {
+			return
+		}
+		if o.table, err = conf.FieldString("table"); err != nil {
+			return
+		}
+		if o.view, err = conf.FieldString("view"); err != nil {
+			return
+		}
+		var tableSchema string
+		if tableSchema, err = conf.FieldString("table_schema"); err != nil {
+			return
+		}
+		if o.columns, err = parseSchemaColumns(tableSchema); err != nil {
+			return
+		}
+		if o.pkeyColumns, err = conf.FieldStringList("pkey_columns"); err != nil {
+			return
+		}
+		if o.nmsColumn, err = conf.FieldString("nms_column"); err != nil {
+			return
+		}
+		if batchPolicy, err = conf.FieldBatchPolicy("batching"); err != nil {
+			return
+		}
+		return &o, batchPolicy, 1, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+type duckDBOutput struct {
+	path        string
+	schema      string
+	table       string
+	view        string
+	columns     []schemaColumn
+	pkeyColumns []string
+	nmsColumn   string
+	db          *sql.DB
+}
+
+func (o *duckDBOutput) target() string {
+	return pgx.Identifier{o.schema, o.table}.Sanitize()
+}
+
+// Connect creates the sink table and, for tables with a primary key and a view
+// name, the view of the latest version of each row, like createBigQueryPKeyView.
+func (o *duckDBOutput) Connect(ctx context.Context) error {
+	db, err := duckDBOpen(o.path)
+	if err != nil {
+		return fmt.Errorf("duckdb open error: %v", err)
+	}
+	var definitions []string
+	for _, c := range o.columns {
+		definitions = append(definitions, pgx.Identifier{c.Name}.Sanitize()+" "+duckDBType(c))
+	}
+	definitions = append(definitions, "snapshot_tm TIMESTAMPTZ")
+	statements := []string{
+		"CREATE SCHEMA IF NOT EXISTS " + pgx.Identifier{o.schema}.Sanitize(),
+		"CREATE TABLE IF NOT EXISTS " + o.target() + " (" + strings.Join(definitions, ", ") + ")",
+	}
+	if len(o.pkeyColumns) > 0 && o.view != "" {
+		statements = append(statements, "CREATE OR REPLACE VIEW "+pgx.Identifier{o.schema, o.view}.Sanitize()+" AS SELECT * FROM "+o.target()+
+			" QUALIFY row_number() OVER (PARTITION BY "+identifierList(o.pkeyColumns)+" ORDER BY snapshot_tm DESC, "+pgx.Identifier{o.nmsColumn}.Sanitize()+" DESC) = 1")
+	}
+	for _, statement := range statements {
+		_, err = db.ExecContext(ctx, statement)
+		if err != nil {
+			duckDBRelease(o.path)
+			return fmt.Errorf("duckdb create error: %v", err)
+		}
+	}
+	o.db = db
+	return nil
+}
+
+// value formats a row value as text, DuckDB casts it to the column's type.
+func (o *duckDBOutput) value(c schemaColumn, v any) (any, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case time.Time:
+		if duckDBType(c) == "TIMESTAMPTZ" {
+			return v.Format("2006-01-02 15:04:05.999999-07:00"), nil
+		}
+		return v.Format("2006-01-02 15:04:05.999999"), nil
+	case map[string]any, []any:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+	return cast.ToStringE(v)
+}
+
+// WriteBatch appends the batch's rows in a single transaction.
+func (o *duckDBOutput) WriteBatch(ctx context.Context, batch service.MessageBatch) error {
+	if o.db == nil {
+		return service.ErrNotConnected
+	}
+	columns := append(o.columns[:len(o.columns):len(o.columns)], schemaColumn{Name: "snapshot_tm", UDTName: "timestamptz"})
+	var names, params []string
+	for _, c := range columns {
+		names = append(names, pgx.Identifier{c.Name}.Sanitize())
+		params = append(params, "CAST(? AS "+duckDBType(c)+")")
+	}
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("duckdb begin error: %v", err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO "+o.target()+" ("+strings.Join(names, ", ")+") VALUES ("+strings.Join(params, ", ")+")")
+	if err != nil {
+		return fmt.Errorf("duckdb prepare error: %v", err)
+	}
+	defer stmt.Close()
+	for _, msg := range batch {
+		structured, err := msg.AsStructured()
+		if err != nil {
+			return fmt.Errorf("duckdb message read error: %v", err)
+		}
+		row, ok := structured.(map[string]any)
+		if !ok {
+			return fmt.Errorf("duckdb message is not an object: %T", structured)
+		}
+		var values []any
+		for _, c := range columns {
+			v, err := o.value(c, row[c.Name])
+			if err != nil {
+				return fmt.Errorf("duckdb column %v value error: %v", c.Name, err)
+			}
+			values = append(values, v)
+		}
+		_, err = stmt.ExecContext(ctx, values...)
+		if err != nil {
+			return fmt.Errorf("duckdb insert error: %v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("duckdb commit error: %v", err)
+	}
+	return nil
+}
+
+func (o *duckDBOutput) Close(ctx context.Context) error {
+	if o.db == nil {
+		return nil
+	}
+	o.db = nil
+	return duckDBRelease(o.path)
+}
@@ -0,0 +1,6 @@
+//go:build !duckdb
+
+package main
+
+// duckDBSupported is false in builds without the duckdb tag, the DuckDB driver requires cgo.
+const duckDBSupported = false
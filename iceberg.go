@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/iceberg-go"
+	"github.com/apache/iceberg-go/catalog"
+	_ "github.com/apache/iceberg-go/catalog/sql"
+	icebergtable "github.com/apache/iceberg-go/table"
+	"github.com/spf13/cast"
+)
+
+// icebergType maps a PostgreSQL column to its Iceberg type:
+//
+//	int2, int4                    int
+//	int8                          long
+//	float4, float8                float, double
+//	numeric(p,s), p <= 38         decimal(p,s)
+//	bool                          boolean
+//	date                          date
+//	timestamp, timestamptz        timestamp, timestamptz
+//	anything else                 string (arrays as JSON)
+func icebergType(c schemaColumn) iceberg.Type {
+	if c.DataType == "ARRAY" {
+		return iceberg.PrimitiveTypes.String
+	}
+	switch c.UDTName {
+	case "int2", "int4":
+		return iceberg.PrimitiveTypes.Int32
+	case "int8":
+		return iceberg.PrimitiveTypes.Int64
+	case "float4":
+		return iceberg.PrimitiveTypes.Float32
+	case "float8":
+		return iceberg.PrimitiveTypes.Float64
+	case "numeric":
+		if c.Precision != nil && c.Scale != nil && *c.Precision > 0 && *c.Precision <= 38 {
+			return iceberg.DecimalTypeOf(int(*c.Precision), int(*c.Scale))
+		}
+	case "bool":
+		return iceberg.PrimitiveTypes.Bool
+	case "date":
+		return iceberg.PrimitiveTypes.Date
+	case "timestamp":
+		return iceberg.PrimitiveTypes.Timestamp
+	case "timestamptz":
+		return iceberg.PrimitiveTypes.TimestampTz
+	}
+	return iceberg.PrimitiveTypes.String
+}
+
+// icebergSchema returns the Iceberg schema of t's sink table.
+func icebergSchema(t table) (*iceberg.Schema, error) {
+	tableSchema, err := sinkTableSchema(t)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := parseSchemaColumns(tableSchema)
+	if err != nil {
+		return nil, err
+	}
+	var fields []iceberg.NestedField
+	for i, c := range columns {
+		fields = append(fields, iceberg.NestedField{ID: i + 1, Name: c.Name, Type: icebergType(c)})
+	}
+	fields = append(fields, iceberg.NestedField{ID: len(columns) + 1, Name: "snapshot_tm", Type: iceberg.PrimitiveTypes.TimestampTz})
+	return iceberg.NewSchema(0, fields...), nil
+}
+
+var icebergPartitionField = regexp.MustCompile(`^\s*(\w+(?:\[\d+\])?)\((\w+)\)\s*$`)
+
+// icebergPartitionSpec parses a comma separated list of partition fields in the
+// form transform(column), ie. "day(updated_at), bucket[16](id), identity(region)".
+func icebergPartitionSpec(spec string, schema *iceberg.Schema) (iceberg.PartitionSpec, error) {
+	var fields []iceberg.PartitionField
+	if strings.TrimSpace(spec) == "" {
+		return *iceberg.UnpartitionedSpec, nil
+	}
+	for i, field := range strings.Split(spec, ",") {
+		matches := icebergPartitionField.FindStringSubmatch(field)
+		if matches == nil {
+			return iceberg.PartitionSpec{}, fmt.Errorf("invalid partition field %q, expecting transform(column)", field)
+		}
+		transform, err := iceberg.ParseTransform(matches[1])
+		if err != nil {
+			return iceberg.PartitionSpec{}, err
+		}
+		source, ok := schema.FindFieldByName(matches[2])
+		if !ok {
+			return iceberg.PartitionSpec{}, fmt.Errorf("partition column %q not found", matches[2])
+		}
+		name := matches[2]
+		if _, identity := transform.(iceberg.IdentityTransform); !identity {
+			name += "_" + strings.NewReplacer("[", "_", "]", "").Replace(matches[1])
+		}
+		fields = append(fields, iceberg.PartitionField{SourceID: source.ID, FieldID: 1000 + i, Name: name, Transform: transform})
+	}
+	return iceberg.NewPartitionSpec(fields...), nil
+}
+
+// icebergPartition returns t's partition spec: its iceberg_partition state
+// column, or ICEBERG_PARTITION_N for its source.
+func icebergPartition(t table) string {
+	if t.IcebergPartition != "" {
+		return t.IcebergPartition
+	}
+	return os.Getenv("ICEBERG_PARTITION_" + cast.ToString(t.DSNEnum))
+}
+
+// icebergCatalog loads the ICEBERG_CATALOG_TYPE catalog (default: a sql
+// catalog in ./sqlite/iceberg-catalog.db) with ICEBERG_WAREHOUSE as warehouse
+// (default: ./output/iceberg, s3:// and gs:// locations are supported).
+func icebergCatalog(ctx context.Context) (catalog.Catalog, error) {
+	warehouse := os.Getenv("ICEBERG_WAREHOUSE")
+	if warehouse == "" {
+		path, err := filepath.Abs("./output/iceberg")
+		if err != nil {
+			return nil, err
+		}
+		warehouse = "file://" + path
+	}
+	props := iceberg.Properties{
+		"type":      "sql",
+		"uri":       "file:./sqlite/iceberg-catalog.db",
+		"warehouse": warehouse,
+	}
+	if catalogType := os.Getenv("ICEBERG_CATALOG_TYPE"); catalogType != "" {
+		props["type"] = catalogType
+	}
+	if uri := os.Getenv("ICEBERG_CATALOG_URI"); uri != "" {
+		props["uri"] = uri
+	}
+	if props["type"] == "sql" {
+		props["sql.driver"] = "sqlite"
+		props["sql.dialect"] = "sqlite"
+		err := os.MkdirAll("sqlite", 0755)
+		if err != nil {
+			return nil, fmt.Errorf("iceberg catalog directory create error: %v", err)
+		}
+	}
+	return catalog.Load(ctx, "leftshove", props)
+}
+
+// icebergNamespace returns the Iceberg namespace of t, ICEBERG_NAMESPACE_N or its source schema.
+func icebergNamespace(t table) string {
+	if namespace := os.Getenv("ICEBERG_NAMESPACE_" + cast.ToString(t.DSNEnum)); namespace != "" {
+		return namespace
+	}
+	return t.Schema
+}
+
+// icebergStagingPath is the file t's window rows are written to before being
+// committed to Iceberg as one snapshot.
+func icebergStagingPath(t table) string {
+	return "./output/iceberg_staging/" + deliveredTableKey(t) + ".json"
+}
+
+// newIcebergStreamConfig returns the output staging t's window rows, left
+// behind rows of a failed window are discarded.
+func newIcebergStreamConfig(t table) (string, error) {
+	err := os.MkdirAll("output/iceberg_staging", 0755)
+	if err != nil {
+		return "", fmt.Errorf("iceberg staging directory create error: %v", err)
+	}
+	err = os.Remove(icebergStagingPath(t))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("iceberg staging file remove error: %v", err)
+	}
+	outputYAML := `file:
+  path: {path}
+  codec: lines`
+	return strings.Replace(outputYAML, "{path}", yamlString(icebergStagingPath(t)), 1), nil
+}
+
+// loadIcebergTable loads t's sink table, creating its namespace and the table
+// with its partition spec if they don't exist. An existing table's schema is
+// reconciled with t's sink schema.
+func loadIcebergTable(ctx context.Context, cat catalog.Catalog, t table) (*icebergtable.Table, error) {
+	namespace := icebergtable.Identifier{icebergNamespace(t)}
+	ident := icebergtable.Identifier{icebergNamespace(t), sinkTableName(t)}
+	exists, err := cat.CheckTableExists(ctx, ident)
+	if err != nil {
+		return nil, fmt.Errorf("iceberg table check error: %v", err)
+	}
+	if exists {
+		tbl, err := cat.LoadTable(ctx, ident)
+		if err != nil {
+			return nil, fmt.Errorf("iceberg table load error: %v", err)
+		}
+		return reconcileIcebergSchema(ctx, cat, tbl, t)
+	}
+	nsExists, err := cat.CheckNamespaceExists(ctx, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("iceberg namespace check error: %v", err)
+	}
+	if !nsExists {
+		err = cat.CreateNamespace(ctx, namespace, nil)
+		if err != nil {
+			return nil, fmt.Errorf("iceberg namespace create error: %v", err)
+		}
+	}
+	schema, err := icebergSchema(t)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := icebergPartitionSpec(icebergPartition(t), schema)
+	if err != nil {
+		return nil, fmt.Errorf("iceberg partition spec error: %v", err)
+	}
+	return cat.CreateTable(ctx, ident, schema, catalog.WithPartitionSpec(&spec))
+}
+
+// reconcileIcebergSchema commits a new schema to t's Iceberg table when t's
+// sink schema has columns the table lacks, which are added, or types Iceberg
+// promotes (int to long, float to double, wider decimals), which are widened.
+// Columns no longer captured stay in the table, other type changes fail.
+func reconcileIcebergSchema(ctx context.Context, cat catalog.Catalog, tbl *icebergtable.Table, t table) (*icebergtable.Table, error) {
+	wanted, err := icebergSchema(t)
+	if err != nil {
+		return nil, err
+	}
+	current := tbl.Schema()
+	fields := current.Fields()
+	lastColumnID := tbl.Metadata().LastColumnID()
+	var changes []string
+	for _, w := range wanted.Fields() {
+		f, ok := current.FindFieldByName(w.Name)
+		if !ok {
+			lastColumnID++
+			fields = append(fields, iceberg.NestedField{ID: lastColumnID, Name: w.Name, Type: w.Type})
+			changes = append(changes, "add "+w.Name+" "+w.Type.String())
+			continue
+		}
+		if f.Type.Equals(w.Type) {
+			continue
+		}
+		if !icebergPromotable(f.Type, w.Type) {
+			return nil, fmt.Errorf("iceberg table %v column %v can't change type from %v to %v", strings.Join(tbl.Identifier(), "."), w.Name, f.Type, w.Type)
+		}
+		for i := range fields {
+			if fields[i].ID == f.ID {
+				fields[i].Type = w.Type
+			}
+		}
+		changes = append(changes, "widen "+w.Name+" to "+w.Type.String())
+	}
+	if len(changes) == 0 {
+		return tbl, nil
+	}
+	schema := iceberg.NewSchemaWithIdentifiers(current.ID+1, current.IdentifierFieldIDs, fields...)
+	_, _, err = cat.CommitTable(ctx, tbl.Identifier(),
+		[]icebergtable.Requirement{icebergtable.AssertCurrentSchemaID(current.ID)},
+		[]icebergtable.Update{icebergtable.NewAddSchemaUpdate(schema), icebergtable.NewSetCurrentSchemaUpdate(-1)})
+	if err != nil {
+		return nil, fmt.Errorf("iceberg schema update error: %v", err)
+	}
+	log.Printf("iceberg table %v schema updated: %v\n", strings.Join(tbl.Identifier(), "."), strings.Join(changes, ", "))
+	return cat.LoadTable(ctx, tbl.Identifier())
+}
+
+// icebergPromotable reports whether Iceberg allows a column of type from to
+// change to type to. Decimals only widen their precision.
+func icebergPromotable(from, to iceberg.Type) bool {
+	if fromDecimal, ok := from.(iceberg.DecimalType); ok {
+		toDecimal, ok := to.(iceberg.DecimalType)
+		return ok && toDecimal.Scale() == fromDecimal.Scale() && toDecimal.Precision() >= fromDecimal.Precision()
+	}
+	_, err := iceberg.PromoteType(from, to)
+	return err == nil
+}
+
+// commitIcebergWindow appends t's staged window rows to its Iceberg table in a
+// single snapshot and returns the id of the table's current snapshot.
+func commitIcebergWindow(t table) (int64, error) {
+	ctx := context.Background()
+	b, err := os.ReadFile(icebergStagingPath(t))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("iceberg staging file read error: %v", err)
+	}
+	cat, err := icebergCatalog(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("iceberg catalog load error: %v", err)
+	}
+	tbl, err := loadIcebergTable(ctx, cat, t)
+	if err != nil {
+		return 0, err
+	}
+	if len(bytes.TrimSpace(b)) > 0 {
+		arrowSchema, err := icebergtable.SchemaToArrowSchema(tbl.Schema(), nil, false, false)
+		if err != nil {
+			return 0, fmt.Errorf("iceberg arrow schema error: %v", err)
+		}
+		rows, err := icebergRows(b, arrowSchema)
+		if err != nil {
+			return 0, err
+		}
+		rdr := array.NewJSONReader(bytes.NewReader(rows), arrowSchema, array.WithChunk(10000))
+		defer rdr.Release()
+		tbl, err = tbl.Append(ctx, rdr, iceberg.Properties{
+			"leftshove.window-start": t.NMS.Add(-lookbackDuration(t)).Format(time.RFC3339Nano),
+			"leftshove.window-end":   t.NewNMS.Format(time.RFC3339Nano),
+		})
+		if err != nil {
+			return 0, fmt.Errorf("iceberg append error: %v", err)
+		}
+	}
+	err = os.Remove(icebergStagingPath(t))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("iceberg staging file remove error: %v", err)
+	}
+	if snapshot := tbl.CurrentSnapshot(); snapshot != nil {
+		return snapshot.SnapshotID, nil
+	}
+	return t.IcebergSnapshotID, nil
+}
+
+// icebergRows rewrites staged rows to the JSON the arrow reader expects for
+// schema: arrays and objects of string columns as JSON text and dates without
+// their time.
+func icebergRows(staged []byte, schema *arrow.Schema) ([]byte, error) {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(staged))
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		dec.UseNumber()
+		var row map[string]any
+		err := dec.Decode(&row)
+		if err != nil {
+			return nil, fmt.Errorf("iceberg staged row parse error: %v", err)
+		}
+		for _, field := range schema.Fields() {
+			v, ok := row[field.Name]
+			if !ok || v == nil {
+				continue
+			}
+			switch field.Type.ID() {
+			case arrow.STRING, arrow.LARGE_STRING:
+				if _, isString := v.(string); !isString {
+					b, err := json.Marshal(v)
+					if err != nil {
+						return nil, fmt.Errorf("iceberg staged value marshal error: %v", err)
+					}
+					row[field.Name] = string(b)
+				}
+			case arrow.DATE32:
+				if s, isString := v.(string); isString && len(s) > 10 {
+					row[field.Name] = s[:10]
+				}
+			}
+		}
+		b, err := json.Marshal(row)
+		if err != nil {
+			return nil, fmt.Errorf("iceberg staged row marshal error: %v", err)
+		}
+		out.Write(b)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("iceberg staging file scan error: %v", err)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+// kafkaTopicInvalidChars matches the characters Kafka doesn't accept in topic
+// names, which unlike table names may contain '.' and '-'.
+var kafkaTopicInvalidChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// kafkaTopicName returns the topic t's rows are published to.
+func kafkaTopicName(t table) string {
+	if t.stagingTable != "" {
+		return t.stagingTable
+	}
+	name := tableTemplateVars(t).Replace(sinkTemplate("KAFKA_TOPIC_TEMPLATE", t, defaultSinkBase(t)+"_cdc"))
+	return kafkaTopicInvalidChars.ReplaceAllString(name, "_")
+}
+
+// bloblangPath returns the Bloblang path of column in the input row.
+func bloblangPath(column string) string {
+	return "this." + strconv.Quote(column)
+}
+
+// newKafkaHeadersProcessor returns a mapping setting the metadata Kafka messages
+// are published with: the message key, from t's primary key values (a JSON
+// array for composite keys), and the dsn, table, window bounds and snapshot_tm
+// headers.
+func newKafkaHeadersProcessor(t table) string {
+	var b strings.Builder
+	b.WriteString("mapping: |\n")
+	b.WriteString("  root = this\n")
+	fmt.Fprintf(&b, "  meta leftshove_dsn = %v\n", strconv.Quote(cast.ToString(t.DSNEnum)))
+	fmt.Fprintf(&b, "  meta leftshove_table = %v\n", strconv.Quote(t.Schema+"."+t.Name))
+	fmt.Fprintf(&b, "  meta leftshove_window_start = %v\n", strconv.Quote(t.NMS.Add(-lookbackDuration(t)).Format(time.RFC3339Nano)))
+	fmt.Fprintf(&b, "  meta leftshove_window_end = %v\n", strconv.Quote(t.NewNMS.Format(time.RFC3339Nano)))
+	b.WriteString("  meta leftshove_snapshot_tm = this.snapshot_tm.string()\n")
+	switch len(t.PKeyColumns) {
+	case 0:
+	case 1:
+		fmt.Fprintf(&b, "  meta leftshove_key = %v.string()\n", bloblangPath(t.PKeyColumns[0]))
+	default:
+		var pkeys []string
+		for _, column := range t.PKeyColumns {
+			pkeys = append(pkeys, bloblangPath(column))
+		}
+		fmt.Fprintf(&b, "  meta leftshove_key = [%v].format_json(\"\").string().replace_all(\"\\n\", \"\")\n", strings.Join(pkeys, ", "))
+	}
+	return b.String()
+}
+
+// newKafkaStreamConfig returns the kafka output of t. Messages of a key go to
+// the same partition, and with one batch in flight (KAFKA_MAX_IN_FLIGHT) are
+// delivered in order. The stream only completes once every message is acked,
+// all in-sync replicas acking when KAFKA_ACK_REPLICAS=true.
+func newKafkaStreamConfig(t table) (string, error) {
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		return "", fmt.Errorf("missing env var: kafka_brokers")
+	}
+	maxInFlight := os.Getenv("KAFKA_MAX_IN_FLIGHT")
+	if maxInFlight == "" {
+		maxInFlight = cast.ToString(1)
+	}
+	batchCount := os.Getenv("KAFKA_BATCH_COUNT")
+	if batchCount == "" {
+		batchCount = cast.ToString(1000)
+	}
+	batchPeriod := os.Getenv("KAFKA_BATCH_PERIOD")
+	if batchPeriod == "" {
+		batchPeriod = "1s"
+	}
+	compression := os.Getenv("KAFKA_COMPRESSION")
+	if compression == "" {
+		compression = "none"
+	}
+	outputYAML := `kafka:
+  addresses: [ {brokers} ]
+  topic: {topic}
+  key: '${! meta("leftshove_key") }'
+  partitioner: fnv1a_hash
+  compression: {compression}
+  max_in_flight: {maxInFlight}
+  ack_replicas: {ackReplicas}
+  metadata:
+    exclude_prefixes: [ "leftshove_key" ]
+  batching:
+    count: {batchCount}
+    period: "{batchPeriod}"`
+	outputConf := strings.NewReplacer(
+		"{brokers}", yamlString(brokers),
+		"{topic}", yamlString(kafkaTopicName(t)),
+		"{compression}", compression,
+		"{maxInFlight}", maxInFlight,
+		"{ackReplicas}", cast.ToString(cast.ToBool(os.Getenv("KAFKA_ACK_REPLICAS"))),
+		"{batchCount}", batchCount,
+		"{batchPeriod}", batchPeriod,
+	).Replace(outputYAML)
+	return outputConf, nil
+}
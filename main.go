@@ -12,10 +12,6 @@ import (
 )
 
 func main() {
-	Singleton("127.0.0.1:51337")
-	log.Printf("⬅🖐 leftshove started")
-	CtrlC()
-
 	var confFile string
 	flag.StringVar(&confFile, "config", "./sample.env", "configuration .env file location (ie. './config.env')")
 	seedFlag := flag.Bool("seed", false, "seed nms db")
@@ -24,10 +20,52 @@ func main() {
 	bqGenFlag := flag.Bool("bq", false, "generate bigquery table schemas")
 	flag.Parse()
 
+	// verify and backfill don't move any table's nms, they can run alongside a
+	// capturing instance
+	if flag.Arg(0) != "verify" && flag.Arg(0) != "backfill" {
+		Singleton("127.0.0.1:51337")
+	}
+	log.Printf("⬅🖐 leftshove started")
+	CtrlC()
+
 	err := godotenv.Load(confFile)
 	if err != nil {
 		log.Fatal("error loading .env file")
 	}
+	err = checkMungeEnv()
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	// commands run without the single instance lock, so never alongside a
+	// seed or capture of their own
+	if flag.Arg(0) != "" && (*seedFlag || *bqGenFlag || *cdcFlag) {
+		log.Printf("%v: -seed, -bq and -cdc can't be combined with a command", flag.Arg(0))
+		os.Exit(1)
+	}
+	switch flag.Arg(0) {
+	case "":
+	case "verify":
+		err := verifyCommand(flag.Args()[1:])
+		if err != nil {
+			log.Println(err)
+			os.Exit(6)
+		}
+		log.Printf("End")
+		return
+	case "backfill":
+		err := backfillCommand(flag.Args()[1:])
+		if err != nil {
+			log.Println(err)
+			os.Exit(7)
+		}
+		log.Printf("End")
+		return
+	default:
+		log.Printf("unknown command: %v", flag.Arg(0))
+		os.Exit(1)
+	}
 
 	if *seedFlag {
 		fmt.Printf("seed nms db: %v\n", *seedFlag)
@@ -46,19 +84,27 @@ func main() {
 	}
 	if *cdcFlag {
 		fmt.Printf("cdc: %v\n", *cdcFlag)
+		err := validateUserConfigs()
+		if err != nil {
+			log.Println(err)
+			os.Exit(3)
+		}
+		err = resetInterruptedRecaptures()
+		if err != nil {
+			log.Println(err)
+			os.Exit(3)
+		}
 		if *runOnce {
-			err := cdc()
+			err := cdc(nil)
 			if err != nil {
 				log.Println(err)
 				os.Exit(3)
 			}
 		} else {
-			for {
-				err := cdc()
-				if err != nil {
-					log.Println(err)
-					os.Exit(4)
-				}
+			err := runScheduler()
+			if err != nil {
+				log.Println(err)
+				os.Exit(4)
 			}
 		}
 
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// gauges holds the latest value of each exported metric, keyed by name and labels.
+var gauges = struct {
+	sync.Mutex
+	values map[string]float64
+}{values: make(map[string]float64)}
+
+// setGauge records value for the metric name with Prometheus formatted labels (ie. `dsn="1"`).
+func setGauge(name, labels string, value float64) {
+	key := name
+	if labels != "" {
+		key = name + "{" + labels + "}"
+	}
+	gauges.Lock()
+	gauges.values[key] = value
+	gauges.Unlock()
+}
+
+// metricsHandler serves gauges in the Prometheus text exposition format.
+func metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	gauges.Lock()
+	keys := make([]string, 0, len(gauges.values))
+	for k := range gauges.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	var lastName string
+	for _, k := range keys {
+		name, _, _ := strings.Cut(k, "{")
+		if name != lastName {
+			fmt.Fprintf(&b, "# TYPE %v gauge\n", name)
+			lastName = name
+		}
+		fmt.Fprintf(&b, "%v %v\n", k, gauges.values[k])
+	}
+	gauges.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+var sinkNameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// tableTemplateVars fills the {source}, {dsn}, {schema}, {table}, {pkey}
+// (comma separated primary key columns) and {nms_column} template variables
+// for t.
+func tableTemplateVars(t table) *strings.Replacer {
+	return strings.NewReplacer(tableTemplateValues(t)...)
+}
+
+// tableTemplateValues returns the table template variables of t followed by
+// their value, as strings.NewReplacer pairs.
+func tableTemplateValues(t table) []string {
+	dsn := cast.ToString(t.DSNEnum)
+	source := os.Getenv("PG_SOURCE_NAME_" + dsn)
+	if source == "" {
+		source = dsn
+	}
+	return []string{"{source}", source, "{dsn}", dsn, "{schema}", t.Schema, "{table}", t.Name, "{pkey}", strings.Join(t.PKeyColumns, ","), "{nms_column}", t.NMSColumn}
+}
+
+// renderSinkName fills a sink naming template's variables for t. Characters
+// sinks don't accept in names become '_'.
+func renderSinkName(template string, t table) string {
+	name := tableTemplateVars(t).Replace(template)
+	return sinkNameInvalidChars.ReplaceAllString(name, "_")
+}
+
+// sinkTemplate returns the source's template from env var name, falling back to
+// the global one and then to def.
+func sinkTemplate(name string, t table, def string) string {
+	if template := os.Getenv(name + "_" + cast.ToString(t.DSNEnum)); template != "" {
+		return template
+	}
+	if template := os.Getenv(name); template != "" {
+		return template
+	}
+	return def
+}
+
+// defaultSinkBase is the base of the default sink names. Tables of sources
+// capturing several schemas are prefixed with their schema so that same-named
+// tables don't collide.
+func defaultSinkBase(t table) string {
+	patterns := schemaPatterns(os.Getenv("PG_SCHEMA_NAME_" + cast.ToString(t.DSNEnum)))
+	if len(patterns) > 1 || (len(patterns) == 1 && strings.ContainsAny(patterns[0], "*?[")) {
+		return "{schema}_{table}"
+	}
+	return "{table}"
+}
+
+// sinkTableName returns the name of the table t's windows are appended to.
+func sinkTableName(t table) string {
+	if t.stagingTable != "" {
+		return t.stagingTable
+	}
+	return renderSinkName(sinkTemplate("SINK_TABLE_NAME_TEMPLATE", t, defaultSinkBase(t)+"_cdc"), t)
+}
+
+// sinkViewName returns the name of t's current state view.
+func sinkViewName(t table) string {
+	return renderSinkName(sinkTemplate("SINK_VIEW_NAME_TEMPLATE", t, defaultSinkBase(t)), t)
+}
+
+// sinkStateTableName returns the name of the current state table the PG and
+// ClickHouse sinks upsert t's rows into, or of its staging table.
+func sinkStateTableName(t table) string {
+	if t.stagingTable != "" {
+		return t.stagingTable
+	}
+	return sinkViewName(t)
+}
+
+// sinkCurrentTableName returns the name of t's deduplicated current state table.
+func sinkCurrentTableName(t table) string {
+	return sinkViewName(t) + "_current"
+}
+
+// sinkNamespace returns the namespace sink names must be unique in.
+func sinkNamespace(t table) string {
+	switch os.Getenv("OUTPUT_TYPE") {
+	case "BQ":
+		return os.Getenv("BQ_PROJECT") + "." + os.Getenv("BQ_DATASET_"+cast.ToString(t.DSNEnum))
+	case "KAFKA":
+		return os.Getenv("KAFKA_BROKERS")
+	case "PG":
+		return os.Getenv("PG_SINK_URL") + "/" + pgSinkSchema(t)
+	case "CLICKHOUSE":
+		return os.Getenv("CH_URL") + "/" + clickHouseDatabase(t)
+	case "DUCKDB":
+		return duckDBPath() + "/" + duckDBSchema(t)
+	case "ICEBERG":
+		return icebergNamespace(t)
+	default:
+		return os.Getenv("OUTPUT_TYPE")
+	}
+}
+
+// checkSinkNameCollisions returns an error listing every sink name claimed by
+// more than one table.
+func checkSinkNameCollisions(tables []table) error {
+	owners := make(map[string]string)
+	var collisions []string
+	for _, t := range tables {
+		owner := fmt.Sprintf("%v.%v.%v", t.DSNEnum, t.Schema, t.Name)
+		names := []string{sinkTableName(t)}
+		switch os.Getenv("OUTPUT_TYPE") {
+		case "KAFKA":
+			names = []string{kafkaTopicName(t)}
+		case "PG", "CLICKHOUSE":
+			names = []string{sinkViewName(t)}
+		}
+		if (os.Getenv("OUTPUT_TYPE") == "BQ" || os.Getenv("OUTPUT_TYPE") == "DUCKDB") && len(t.PKeyColumns) > 0 {
+			names = append(names, sinkViewName(t))
+		}
+		if currentTableEnabled(t) {
+			names = append(names, sinkCurrentTableName(t))
+		}
+		for _, name := range names {
+			key := sinkNamespace(t) + "." + name
+			if other, ok := owners[key]; ok {
+				collisions = append(collisions, fmt.Sprintf("%v (%v, %v)", key, other, owner))
+				continue
+			}
+			owners[key] = owner
+		}
+	}
+	if len(collisions) > 0 {
+		return fmt.Errorf("sink name collisions, set SINK_TABLE_NAME_TEMPLATE/SINK_VIEW_NAME_TEMPLATE: %v", strings.Join(collisions, "; "))
+	}
+	return nil
+}
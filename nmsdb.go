@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/bigquery"
@@ -25,9 +26,84 @@ type table struct {
 	BQSchema     string    `json:"bq_schema"`
 	TableSchema  string    `json:"table_schema"`
 	Query        string    `json:"query"`
+	QueryArgs    []string  `json:"query_args"`
 	stream       *service.Stream
+	// capturedFrom is the source time at which the current window's capture started.
+	capturedFrom time.Time
 	NMSColumn    string `json:"nms_column"`
-	PKeyColumn   string `json:"pkey_column"`
+	// PKeyColumns is the ordered list of t's primary key columns.
+	PKeyColumns []string `json:"pkey_columns"`
+	// CaptureInterval and CaptureCron override the source's capture schedule for this table.
+	CaptureInterval int64  `json:"capture_interval_secs"`
+	CaptureCron     string `json:"capture_cron"`
+	// LookbackSecs overrides PG_LOOKBACK_SECS_N, how far each window re-reads into the previous one.
+	LookbackSecs int64 `json:"lookback_secs"`
+	// ProcessorConfFile is a Benthos processors file applied to this table after BENTHOS_PROCESSOR_CONF_FILE.
+	ProcessorConfFile string `json:"processor_conf_file"`
+	// IcebergPartition overrides ICEBERG_PARTITION_N, the partition spec of the table's Iceberg sink table.
+	IcebergPartition string `json:"iceberg_partition"`
+	// IcebergSnapshotID is the Iceberg snapshot holding the rows up to NMS.
+	IcebergSnapshotID int64 `json:"iceberg_snapshot_id"`
+	// recaptureID is the nmsrecaptures id of a window captured again, which
+	// doesn't move the nms.
+	recaptureID int
+	// stagingTable replaces the sink table name of a recaptured window.
+	stagingTable string
+	// rules are the user rules of the cycle capturing t.
+	rules *userRules
+}
+
+// stateColumn is a column added to a state table after its initial layout.
+type stateColumn struct {
+	name       string
+	definition string
+}
+
+// nmsColumns lists columns added to nmstables after its initial layout, so
+// state databases created by older versions can be migrated in place.
+var nmsColumns = []stateColumn{
+	{"capture_interval_secs", "INTEGER NULL"},
+	{"capture_cron", "VARCHAR(255) NULL"},
+	{"lookback_secs", "INTEGER NULL"},
+	{"processor_conf_file", "VARCHAR NULL"},
+	{"iceberg_partition", "VARCHAR NULL"},
+	{"iceberg_snapshot_id", "INTEGER NULL"},
+}
+
+// nmsStateTables creates the state tables kept next to nmstables: the run
+// history, a row per captured window, and the queue of windows to capture again.
+var nmsStateTables = []string{`
+CREATE TABLE IF NOT EXISTS nmsruns
+(id INTEGER PRIMARY KEY AUTOINCREMENT,
+table_id INTEGER NOT NULL,
+window_start TIMESTAMP NOT NULL,
+window_end TIMESTAMP NOT NULL,
+finished_on TIMESTAMP NOT NULL,
+sanitized_values VARCHAR NULL,
+recapture_id INTEGER NULL)`, `
+CREATE TABLE IF NOT EXISTS nmsrecaptures
+(id INTEGER PRIMARY KEY AUTOINCREMENT,
+table_id INTEGER NOT NULL,
+window_start TIMESTAMP NOT NULL,
+window_end TIMESTAMP NOT NULL,
+reason VARCHAR NULL,
+queued_on TIMESTAMP NOT NULL,
+captured_on TIMESTAMP NULL,
+sink_table VARCHAR NULL,
+started_on TIMESTAMP NULL,
+error VARCHAR NULL)`,
+}
+
+// nmsRunColumns lists columns added to nmsruns after its initial layout.
+var nmsRunColumns = []stateColumn{
+	{"recapture_id", "INTEGER NULL"},
+}
+
+// nmsRecaptureColumns lists columns added to nmsrecaptures after its initial layout.
+var nmsRecaptureColumns = []stateColumn{
+	{"sink_table", "VARCHAR NULL"},
+	{"started_on", "TIMESTAMP NULL"},
+	{"error", "VARCHAR NULL"},
 }
 
 func nmsDBOpen() (*sql.DB, error) {
@@ -41,6 +117,10 @@ func nmsDBOpen() (*sql.DB, error) {
 		if err != nil {
 			return nil, fmt.Errorf("nmsDBOpen file open error: %v", err)
 		}
+		err = nmsDBMigrate(db)
+		if err != nil {
+			return nil, fmt.Errorf("nmsDBOpen migrate error: %v", err)
+		}
 		return db, nil
 	} else {
 		_, err = os.Create("./sqlite/leftshove-nms.db")
@@ -63,20 +143,84 @@ func nmsDBOpen() (*sql.DB, error) {
 			nms TIMESTAMP NULL,
 			last_row_count INTEGER NULL, 
 			dsn INTEGER NULL,
-			last_shoved_on TIMESTAMP NULL)`
+			last_shoved_on TIMESTAMP NULL,
+			capture_interval_secs INTEGER NULL,
+			capture_cron VARCHAR(255) NULL,
+			lookback_secs INTEGER NULL,
+			processor_conf_file VARCHAR NULL,
+			iceberg_partition VARCHAR NULL,
+			iceberg_snapshot_id INTEGER NULL)`
 			_, err = db.Exec(createStatement)
 			if err != nil {
 				return nil, fmt.Errorf("nmsDBOpen create table error: %v", err)
 			}
+			for _, statement := range nmsStateTables {
+				_, err = db.Exec(statement)
+				if err != nil {
+					return nil, fmt.Errorf("nmsDBOpen create state table error: %v", err)
+				}
+			}
 			return db, nil
 		}
 	}
 }
 
+func nmsDBMigrate(db *sql.DB) error {
+	err := addStateColumns(db, "nmstables", nmsColumns)
+	if err != nil {
+		return err
+	}
+	for _, statement := range nmsStateTables {
+		_, err = db.Exec(statement)
+		if err != nil {
+			return fmt.Errorf("nmsdbmigrate create state table error: %v", err)
+		}
+	}
+	err = addStateColumns(db, "nmsruns", nmsRunColumns)
+	if err != nil {
+		return err
+	}
+	return addStateColumns(db, "nmsrecaptures", nmsRecaptureColumns)
+}
+
+// addStateColumns adds the columns missing from state table tableName.
+func addStateColumns(db *sql.DB, tableName string, columns []stateColumn) error {
+	existing := make(map[string]bool)
+	rows, err := db.Query("PRAGMA table_info(" + tableName + ")")
+	if err != nil {
+		return fmt.Errorf("nmsdbmigrate table_info error: %v", err)
+	}
+	for rows.Next() {
+		var cid int
+		var name, colType string
+		var notNull int
+		var dflt sql.NullString
+		var pk int
+		err = rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("nmsdbmigrate scan error: %v", err)
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	for _, c := range columns {
+		if existing[c.name] {
+			continue
+		}
+		_, err = db.Exec("ALTER TABLE " + tableName + " ADD COLUMN " + c.name + " " + c.definition)
+		if err != nil {
+			return fmt.Errorf("nmsdbmigrate add column %v error: %v", c.name, err)
+		}
+		log.Printf("nmsDBMigrate: added column %v.%v\n", tableName, c.name)
+	}
+	return nil
+}
+
 func nmsTablesQuery(nmsDB *sql.DB, fileWrite bool) ([]table, error) {
 	var tables []table
 
-	rows, err := nmsDB.Query("SELECT id, name, schema, table_schema, bq_schema, nms, nmsColumn, pkeyColumn, last_row_count, dsn, last_shoved_on FROM nmstables")
+	rows, err := nmsDB.Query("SELECT id, name, schema, table_schema, bq_schema, nms, nmsColumn, pkeyColumn, last_row_count, dsn, last_shoved_on, capture_interval_secs, capture_cron, lookback_secs, processor_conf_file, iceberg_partition, iceberg_snapshot_id FROM nmstables")
 	if err != nil {
 		return nil, fmt.Errorf("nmsQuery select error: %v", err)
 	}
@@ -93,9 +237,15 @@ func nmsTablesQuery(nmsDB *sql.DB, fileWrite bool) ([]table, error) {
 		var pkeyColumn sql.NullString
 		var rowCount int64
 		var dsn int64
-		var lastShove time.Time
+		var lastShove sql.NullTime
+		var captureInterval sql.NullInt64
+		var captureCron sql.NullString
+		var lookbackSecs sql.NullInt64
+		var processorConfFile sql.NullString
+		var icebergPartition sql.NullString
+		var icebergSnapshotID sql.NullInt64
 		var t table
-		err = rows.Scan(&id, &name, &schema, &tableSchema, &bqSchema, &nms, &nmsColumn, &pkeyColumn, &rowCount, &dsn, &lastShove)
+		err = rows.Scan(&id, &name, &schema, &tableSchema, &bqSchema, &nms, &nmsColumn, &pkeyColumn, &rowCount, &dsn, &lastShove, &captureInterval, &captureCron, &lookbackSecs, &processorConfFile, &icebergPartition, &icebergSnapshotID)
 		if err != nil {
 			return nil, fmt.Errorf("gettableswithnms() scan error: %v", err)
 		}
@@ -106,10 +256,16 @@ func nmsTablesQuery(nmsDB *sql.DB, fileWrite bool) ([]table, error) {
 		t.BQSchema = bqSchema.String
 		t.NMS = nms
 		t.NMSColumn = nmsColumn.String
-		t.PKeyColumn = pkeyColumn.String
+		t.PKeyColumns = parsePKeyColumns(pkeyColumn.String)
 		t.LastRowCount = rowCount
 		t.DSNEnum = dsn
-		t.LastShove = lastShove
+		t.LastShove = lastShove.Time
+		t.CaptureInterval = captureInterval.Int64
+		t.CaptureCron = captureCron.String
+		t.LookbackSecs = lookbackSecs.Int64
+		t.ProcessorConfFile = processorConfFile.String
+		t.IcebergPartition = icebergPartition.String
+		t.IcebergSnapshotID = icebergSnapshotID.Int64
 		tables = append(tables, t)
 	}
 
@@ -123,11 +279,55 @@ func nmsTablesQuery(nmsDB *sql.DB, fileWrite bool) ([]table, error) {
 	return tables, nil
 }
 
+// findTable returns the table of tables named [schema.]name, of source dsn
+// unless dsn is 0.
+func findTable(tables []table, name string, dsn int64) (table, error) {
+	schema, tableName, qualified := strings.Cut(name, ".")
+	if !qualified {
+		schema, tableName = "", name
+	}
+	var found []table
+	for _, t := range tables {
+		if t.Name == tableName && (schema == "" || t.Schema == schema) && (dsn == 0 || t.DSNEnum == dsn) {
+			found = append(found, t)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return table{}, fmt.Errorf("table %v not found", name)
+	case 1:
+		return found[0], nil
+	}
+	return table{}, fmt.Errorf("table %v is ambiguous, set its schema or dsn", name)
+}
+
+// parsePKeyColumns reads the pkeyColumn state column, a JSON array of column
+// names or, in state databases seeded by older versions, a single column name.
+// Tables without a primary key were stored as "null" before being stored as [].
+func parsePKeyColumns(pkeyColumn string) []string {
+	if pkeyColumn == "" || pkeyColumn == "null" {
+		return nil
+	}
+	var columns []string
+	if strings.HasPrefix(pkeyColumn, "[") && json.Unmarshal([]byte(pkeyColumn), &columns) == nil {
+		if len(columns) == 0 {
+			return nil
+		}
+		return columns
+	}
+	return []string{pkeyColumn}
+}
+
 func seedNMSTable(pgTableWithNMS pgTable, nmsDB *sql.DB) error {
 	var id int64
-	err := nmsDB.QueryRow("SELECT id FROM nmstables WHERE name = ? AND dsn = ?", pgTableWithNMS.name, pgTableWithNMS.dsnEnum).Scan(&id)
+	// a table without a primary key is stored as [], not null
+	pkeyColumns, err := json.Marshal(append([]string{}, pgTableWithNMS.pKeyColumns...))
 	if err != nil {
-		log.Printf("seedNMSTable() %v: %v\n", pgTableWithNMS.name, err)
+		return fmt.Errorf("seednmstable() pkey marshal: %v", err)
+	}
+	err = nmsDB.QueryRow("SELECT id FROM nmstables WHERE schema = ? AND name = ? AND dsn = ?", pgTableWithNMS.schema, pgTableWithNMS.name, pgTableWithNMS.dsnEnum).Scan(&id)
+	if err != nil {
+		log.Printf("seedNMSTable() %v.%v: %v\n", pgTableWithNMS.schema, pgTableWithNMS.name, err)
 	}
 	if id > 0 {
 		updateQuery := `
@@ -139,7 +339,7 @@ func seedNMSTable(pgTableWithNMS pgTable, nmsDB *sql.DB) error {
 			nms = ?,
 			last_row_count = ?
 		WHERE name = ? AND id = ?`
-		_, err := nmsDB.Exec(updateQuery, pgTableWithNMS.schema, pgTableWithNMS.pKeyColumn, pgTableWithNMS.tableSchema, pgTableWithNMS.nmsTime, pgTableWithNMS.rowCount, pgTableWithNMS.name, pgTableWithNMS.dsnEnum)
+		_, err := nmsDB.Exec(updateQuery, pgTableWithNMS.schema, string(pkeyColumns), pgTableWithNMS.tableSchema, pgTableWithNMS.nmsTime, pgTableWithNMS.rowCount, pgTableWithNMS.name, id)
 		if err != nil {
 			return fmt.Errorf("seednmstable() update: %v", err)
 		}
@@ -147,8 +347,8 @@ func seedNMSTable(pgTableWithNMS pgTable, nmsDB *sql.DB) error {
 		insertQuery := `
 		INSERT INTO nmstables 
 		(name, schema, pkeyColumn, table_schema, nmsColumn, nms, last_row_count, dsn) 
-		VALUES (?, ?, ?, ?, ?, ?, ?)`
-		_, err := nmsDB.Exec(insertQuery, pgTableWithNMS.name, pgTableWithNMS.schema, pgTableWithNMS.pKeyColumn, pgTableWithNMS.tableSchema, pgTableWithNMS.nmsColumn, pgTableWithNMS.nmsTime, pgTableWithNMS.rowCount, pgTableWithNMS.dsnEnum)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+		_, err := nmsDB.Exec(insertQuery, pgTableWithNMS.name, pgTableWithNMS.schema, string(pkeyColumns), pgTableWithNMS.tableSchema, pgTableWithNMS.nmsColumn, pgTableWithNMS.nmsTime, pgTableWithNMS.rowCount, pgTableWithNMS.dsnEnum)
 		if err != nil {
 			return fmt.Errorf("seednmstable() insert: %v", err)
 		}
@@ -201,12 +401,36 @@ func updateNMS(t table, nmsDB *sql.DB) error {
 	SET 
 		nms = ?,
 		last_row_count = ?,
-		last_shoved_on = datetime('now')
+		last_shoved_on = datetime('now'),
+		iceberg_snapshot_id = ?
 	WHERE id = ?`
 
-	_, err := nmsDB.Exec(updateQuery, t.NewNMS, t.LastRowCount, t.ID)
+	_, err := nmsDB.Exec(updateQuery, t.NewNMS, t.LastRowCount, sql.NullInt64{Int64: t.IcebergSnapshotID, Valid: t.IcebergSnapshotID != 0}, t.ID)
 	if err != nil {
 		return fmt.Errorf("updateNMS() exec error: %v", err)
 	}
 	return nil
 }
+
+// insertRun records t's captured window in the run history, with the counts
+// of values sanitized by column:check.
+func insertRun(t table, sanitized map[string]int, nmsDB *sql.DB) error {
+	var sanitizedValues sql.NullString
+	if len(sanitized) > 0 {
+		b, err := json.Marshal(sanitized)
+		if err != nil {
+			return fmt.Errorf("insertrun() marshal error: %v", err)
+		}
+		sanitizedValues = sql.NullString{String: string(b), Valid: true}
+	}
+	insertQuery := `
+	INSERT INTO nmsruns
+	(table_id, window_start, window_end, finished_on, sanitized_values, recapture_id)
+	VALUES (?, ?, ?, datetime('now'), ?, ?)`
+	recaptureID := sql.NullInt64{Int64: int64(t.recaptureID), Valid: t.recaptureID != 0}
+	_, err := nmsDB.Exec(insertQuery, t.ID, t.NMS.Add(-lookbackDuration(t)), t.NewNMS, sanitizedValues, recaptureID)
+	if err != nil {
+		return fmt.Errorf("insertrun() exec error: %v", err)
+	}
+	return nil
+}
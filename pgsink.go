@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/cast"
+	sugar "github.com/waclawthedev/go-sugaring"
+)
+
+func init() {
+	spec := service.NewConfigSpec().
+		Summary("Upserts captured rows into a leftshove managed PostgreSQL table.").
+		Field(service.NewStringField("url")).
+		Field(service.NewStringField("schema")).
+		Field(service.NewStringField("table")).
+		Field(service.NewStringField("table_schema")).
+		Field(service.NewStringListField("pkey_columns").Default([]any{})).
+		Field(service.NewStringField("nms_column")).
+		Field(service.NewIntField("max_in_flight").Default(1)).
+		Field(service.NewBatchPolicyField("batching"))
+	err := service.RegisterBatchOutput("leftshove_pg", spec, func(conf *service.ParsedConfig, mgr *service.Resources) (out service.BatchOutput, batchPolicy service.BatchPolicy, maxInFlight int, err error) {
+		var o pgSinkOutput
+		if o.url, err = conf.FieldString("url"); err != nil {
+			return
+		}
+		if o.schema, err = conf.FieldString("schema"); err != nil {
+			return
+		}
+		if o.table, err = conf.FieldString("table"); err != nil {
+			return
+		}
+		var tableSchema string
+		if tableSchema, err = conf.FieldString("table_schema"); err != nil {
+			return
+		}
+		if o.columns, err = parseSchemaColumns(tableSchema); err != nil {
+			return
+		}
+		if o.pkeyColumns, err = conf.FieldStringList("pkey_columns"); err != nil {
+			return
+		}
+		if o.nmsColumn, err = conf.FieldString("nms_column"); err != nil {
+			return
+		}
+		if maxInFlight, err = conf.FieldInt("max_in_flight"); err != nil {
+			return
+		}
+		if batchPolicy, err = conf.FieldBatchPolicy("batching"); err != nil {
+			return
+		}
+		return &o, batchPolicy, maxInFlight, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// pgType returns the column's type as declared on the source: type modifiers
+// of character, bit and numeric types are kept, array element modifiers are not.
+func (c schemaColumn) pgType() string {
+	if c.typeOverride != "" {
+		return c.typeOverride
+	}
+	if c.DataType == "ARRAY" {
+		return pgx.Identifier{strings.TrimPrefix(c.UDTName, "_")}.Sanitize() + "[]"
+	}
+	switch c.UDTName {
+	case "varchar", "bpchar", "bit", "varbit":
+		if c.MaxLength != nil {
+			return fmt.Sprintf("%v(%v)", c.UDTName, *c.MaxLength)
+		}
+	case "numeric":
+		if c.Precision != nil && c.Scale != nil {
+			return fmt.Sprintf("numeric(%v,%v)", *c.Precision, *c.Scale)
+		}
+	}
+	if c.DataType == "USER-DEFINED" {
+		return pgx.Identifier{c.UDTName}.Sanitize()
+	}
+	return c.UDTName
+}
+
+type pgSinkOutput struct {
+	url         string
+	schema      string
+	table       string
+	columns     []schemaColumn
+	pkeyColumns []string
+	nmsColumn   string
+	pool        *pgxpool.Pool
+}
+
+// Connect creates the sink table if it doesn't exist. User-defined types (enums,
+// extension types) missing from the sink database are created as text.
+func (o *pgSinkOutput) Connect(ctx context.Context) error {
+	pool, err := pgxpool.New(ctx, o.url)
+	if err != nil {
+		return fmt.Errorf("pg sink connect error: %v", err)
+	}
+	for i, c := range o.columns {
+		if c.DataType != "USER-DEFINED" {
+			continue
+		}
+		var exists bool
+		err = pool.QueryRow(ctx, "SELECT to_regtype($1) IS NOT NULL", c.UDTName).Scan(&exists)
+		if err != nil {
+			pool.Close()
+			return fmt.Errorf("pg sink type lookup error: %v", err)
+		}
+		if !exists {
+			log.Printf("pg sink: type %v of %v.%v.%v missing, using text\n", c.UDTName, o.schema, o.table, c.Name)
+			o.columns[i].typeOverride = "text"
+		}
+	}
+	_, err = pool.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+pgx.Identifier{o.schema}.Sanitize())
+	if err != nil {
+		pool.Close()
+		return fmt.Errorf("pg sink create schema error: %v", err)
+	}
+	_, err = pool.Exec(ctx, o.createStatement())
+	if err != nil {
+		pool.Close()
+		return fmt.Errorf("pg sink create table error: %v", err)
+	}
+	o.pool = pool
+	return nil
+}
+
+func (o *pgSinkOutput) target() string {
+	return pgx.Identifier{o.schema, o.table}.Sanitize()
+}
+
+func (o *pgSinkOutput) createStatement() string {
+	var definitions []string
+	for _, c := range o.columns {
+		definitions = append(definitions, pgx.Identifier{c.Name}.Sanitize()+" "+c.pgType())
+	}
+	definitions = append(definitions, "snapshot_tm timestamptz")
+	if len(o.pkeyColumns) > 0 {
+		definitions = append(definitions, "PRIMARY KEY ("+identifierList(o.pkeyColumns)+")")
+	}
+	return "CREATE TABLE IF NOT EXISTS " + o.target() + " (" + strings.Join(definitions, ", ") + ")"
+}
+
+// upsertStatement applies the staged rows to the sink table. Only the latest
+// version of each key in the batch is kept, and rows never overwrite a newer
+// version already in the table, so replayed windows are harmless.
+func (o *pgSinkOutput) upsertStatement() string {
+	columns := []string{"snapshot_tm"}
+	for _, c := range o.columns {
+		columns = append(columns, c.Name)
+	}
+	columnList := identifierList(columns)
+	rows := "SELECT r.* FROM leftshove_stage, jsonb_populate_record(NULL::" + o.target() + ", doc) r"
+	if len(o.pkeyColumns) == 0 {
+		return "INSERT INTO " + o.target() + " (" + columnList + ") SELECT " + columnList + " FROM (" + rows + ") s"
+	}
+	pkeys := identifierList(o.pkeyColumns)
+	nms := pgx.Identifier{o.nmsColumn}.Sanitize()
+	statement := "INSERT INTO " + o.target() + " AS leftshove_current (" + columnList + ") SELECT " + columnList +
+		" FROM (SELECT DISTINCT ON (" + pkeys + ") * FROM (" + rows + ") r ORDER BY " + pkeys + ", " + nms + " DESC NULLS LAST, snapshot_tm DESC) s" +
+		" ON CONFLICT (" + pkeys + ") DO "
+	var updates []string
+	for _, column := range columns {
+		if !sugar.Contains(o.pkeyColumns, column) {
+			ident := pgx.Identifier{column}.Sanitize()
+			updates = append(updates, ident+" = EXCLUDED."+ident)
+		}
+	}
+	if len(updates) == 0 {
+		return statement + "NOTHING"
+	}
+	return statement + "UPDATE SET " + strings.Join(updates, ", ") +
+		" WHERE leftshove_current." + nms + " IS NULL OR leftshove_current." + nms + " <= EXCLUDED." + nms
+}
+
+// WriteBatch copies the batch's rows into a staging table and upserts them in a
+// single transaction.
+func (o *pgSinkOutput) WriteBatch(ctx context.Context, batch service.MessageBatch) error {
+	if o.pool == nil {
+		return service.ErrNotConnected
+	}
+	var docs [][]any
+	for _, msg := range batch {
+		b, err := msg.AsBytes()
+		if err != nil {
+			return fmt.Errorf("pg sink message read error: %v", err)
+		}
+		docs = append(docs, []any{string(b)})
+	}
+	tx, err := o.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("pg sink begin error: %v", err)
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, "CREATE TEMP TABLE leftshove_stage (doc jsonb) ON COMMIT DROP")
+	if err != nil {
+		return fmt.Errorf("pg sink create staging table error: %v", err)
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"leftshove_stage"}, []string{"doc"}, pgx.CopyFromRows(docs))
+	if err != nil {
+		return fmt.Errorf("pg sink copy error: %v", err)
+	}
+	_, err = tx.Exec(ctx, o.upsertStatement())
+	if err != nil {
+		return fmt.Errorf("pg sink upsert error: %v", err)
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("pg sink commit error: %v", err)
+	}
+	return nil
+}
+
+func (o *pgSinkOutput) Close(ctx context.Context) error {
+	if o.pool != nil {
+		o.pool.Close()
+	}
+	return nil
+}
+
+func identifierList(columns []string) string {
+	var idents []string
+	for _, column := range columns {
+		idents = append(idents, pgx.Identifier{column}.Sanitize())
+	}
+	return strings.Join(idents, ", ")
+}
+
+// pgSinkSchema returns the sink schema of t, PG_SINK_SCHEMA_N or its source schema.
+func pgSinkSchema(t table) string {
+	if schema := os.Getenv("PG_SINK_SCHEMA_" + cast.ToString(t.DSNEnum)); schema != "" {
+		return schema
+	}
+	return t.Schema
+}
+
+// newPGSinkStreamConfig returns the leftshove_pg output upserting t's rows into
+// its current state table in PG_SINK_URL, or into its staging table.
+func newPGSinkStreamConfig(t table) (string, error) {
+	sinkURL := os.Getenv("PG_SINK_URL")
+	if sinkURL == "" {
+		return "", fmt.Errorf("missing env var: pg_sink_url")
+	}
+	tableSchema, err := sinkTableSchema(t)
+	if err != nil {
+		return "", err
+	}
+	pkeys, err := json.Marshal(t.PKeyColumns)
+	if err != nil {
+		return "", fmt.Errorf("pkey columns marshal error: %v", err)
+	}
+	batchCount := os.Getenv("PG_SINK_BATCH_COUNT")
+	if batchCount == "" {
+		batchCount = cast.ToString(10000)
+	}
+	batchPeriod := os.Getenv("PG_SINK_BATCH_PERIOD")
+	if batchPeriod == "" {
+		batchPeriod = "5s"
+	}
+	outputYAML := `leftshove_pg:
+  url: {url}
+  schema: {schema}
+  table: {table}
+  table_schema: {tableSchema}
+  pkey_columns: {pkeys}
+  nms_column: {nmsColumn}
+  batching:
+    count: {batchCount}
+    period: "{batchPeriod}"`
+	outputConf := strings.NewReplacer(
+		"{url}", yamlString(sinkURL),
+		"{schema}", yamlString(pgSinkSchema(t)),
+		"{table}", yamlString(sinkStateTableName(t)),
+		"{tableSchema}", yamlString(tableSchema),
+		"{pkeys}", string(pkeys),
+		"{nmsColumn}", yamlString(t.NMSColumn),
+		"{batchCount}", batchCount,
+		"{batchPeriod}", batchPeriod,
+	).Replace(outputYAML)
+	return outputConf, nil
+}
@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
 	"log"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/Jeffail/gabs/v2"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/spf13/cast"
 
@@ -23,7 +26,7 @@ type pgTable struct {
 	schema      string
 	tableSchema string
 	nmsColumn   string
-	pKeyColumn  string
+	pKeyColumns []string
 }
 
 func getPGConnection(dbURL string) (*pgxpool.Pool, error) {
@@ -40,101 +43,361 @@ func getPGConnection(dbURL string) (*pgxpool.Pool, error) {
 	return conn, nil
 }
 
-func getTableNMSQuery(tableSchema, tableName, nmsColumn, nms, newNMS string, pgDB *pgxpool.Pool) (string, error) {
-	var tableQuery string
-	var queryGenTemplate string = `
-	SELECT 
-		CONCAT(
-			'SELECT ', 
-				ARRAY_TO_STRING(ARRAY_AGG(CONCAT(column_name::TEXT, ' ')), ', '),', 
-				now () AS snapshot_tm 
-			FROM ', table_name, ' 
-			WHERE {minfield} > ','''{nms}''
-				AND {minfield} <= ''{newtimestamp}''') AS query 
-	FROM 
-		(SELECT 
-			table_name, 
-			ordinal_position, 
-			CASE 
-				WHEN udt_name LIKE '\_%' THEN CONCAT('array_to_json(',column_name::TEXT,') AS ', column_name::TEXT) 
-				WHEN udt_name LIKE '{percent}vector' THEN CONCAT('array_to_json(',column_name::TEXT,') AS ', column_name::TEXT)
-				{munging}
-				ELSE column_name::TEXT 
-			END AS column_name 
-			FROM INFORMATION_SCHEMA.columns 
-		WHERE table_schema = '{table_schema}'
-		ORDER BY table_name, ordinal_position) AS schema 
-	WHERE table_name = '{table_name}' 
-	GROUP BY table_name`
-
-	queryGen := strings.Replace(queryGenTemplate, "{percent}", "%", 1)
-	var munging string
-	if cast.ToBool(os.Getenv("MUNGE_TIMESTAMPS_BEFORE_MIN")) {
-		t := cast.ToTime(os.Getenv("MUNGE_MIN_TIMESTAMP"))
-		if !t.IsZero() {
-			if cast.ToBool(os.Getenv("MUNGE_INVALID_TIMESTAMPS_TO_NULL")) {
-				munging = `
-				WHEN udt_name IN ('timestamp', 'timestamptz') 
-					THEN CONCAT('CASE WHEN ',column_name::TEXT,' < ''` + t.Format("2006-01-02 15:04:05") + `'' THEN NULL ELSE ', column_name::TEXT, ' END AS ', column_name::TEXT)`
-			}
-			if cast.ToBool(os.Getenv("MUNGE_INVALID_TIMESTAMPS_TO_MIN")) {
-				munging = `
-					WHEN udt_name IN ('timestamp', 'timestamptz') 
-						THEN CONCAT('CASE WHEN ',column_name::TEXT,' < ''` + t.Format("2006-01-02 15:04:05") + `'' THEN to_timestamp(''` + t.Format("2006-01-02 15:04:05") + `'',''YYYY-MM-DD HH24:MI:SS'') ELSE ', column_name::TEXT, ' END AS ', column_name::TEXT)`
-			}
+// schemaPatterns splits a PG_SCHEMA_NAME_N value, a comma separated list of
+// schema names and globs (ie. "public,billing_*").
+func schemaPatterns(schemaList string) []string {
+	var patterns []string
+	for _, p := range strings.Split(schemaList, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
 		}
 	}
-	if cast.ToBool(os.Getenv("MUNGE_TIMESTAMPS_BEFORE_EPOCH")) {
-		if cast.ToBool(os.Getenv("MUNGE_INVALID_TIMESTAMPS_TO_NULL")) {
-			munging = `
-			WHEN udt_name IN ('timestamp', 'timestamptz') 
-				THEN CONCAT('CASE WHEN ',column_name::TEXT,' < ''1970-01-01 00:00:00'' THEN NULL ELSE ', column_name::TEXT, ' END AS ', column_name::TEXT)`
+	return patterns
+}
+
+// getSourceSchemas returns the source's schemas matching schemaList, in the order of its patterns.
+func getSourceSchemas(schemaList string, pgDB *pgxpool.Pool) ([]string, error) {
+	var schemas []string
+	conn, err := pgDB.Acquire(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("pg conn acquire error: %v", err)
+	}
+	defer conn.Release()
+	rows, err := conn.Query(context.Background(), `SELECT nspname FROM pg_namespace
+	WHERE nspname NOT IN ('pg_catalog', 'information_schema') AND nspname NOT LIKE 'pg\_toast%' AND nspname NOT LIKE 'pg\_temp\_%'
+	ORDER BY nspname`)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %v", err)
+	}
+	defer rows.Close()
+	var existing []string
+	for rows.Next() {
+		var schema string
+		err = rows.Scan(&schema)
+		if err != nil {
+			return nil, fmt.Errorf("getsourceschemas() scan error: %v", err)
 		}
-		if cast.ToBool(os.Getenv("MUNGE_INVALID_TIMESTAMPS_TO_MIN")) {
-			t := cast.ToTime(os.Getenv("MUNGE_MIN_TIMESTAMP"))
-			if !t.IsZero() && t.Before(time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC)) {
-				munging = `
-				WHEN udt_name IN ('timestamp', 'timestamptz') 
-					THEN CONCAT('CASE WHEN ',column_name::TEXT,' < ''` + t.Format("2006-01-02 15:04:05") + `'' THEN to_timestamp(''` + t.Format("2006-01-02 15:04:05") + `'',''YYYY-MM-DD HH24:MI:SS'') ELSE ', column_name::TEXT, ' END AS ', column_name::TEXT)`
+		existing = append(existing, schema)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("rows error: %v", rows.Err())
+	}
+	for _, pattern := range schemaPatterns(schemaList) {
+		for _, schema := range existing {
+			matched, err := path.Match(pattern, schema)
+			if err != nil {
+				return nil, fmt.Errorf("invalid schema pattern %q: %v", pattern, err)
+			}
+			if matched && !sugar.Contains(schemas, schema) {
+				schemas = append(schemas, schema)
 			}
 		}
 	}
-	queryGen = strings.Replace(queryGen, "{munging}", munging, 1)
-	queryGen = strings.Replace(strings.Replace(strings.Replace(strings.Replace(strings.Replace(queryGen, "{minfield}", nmsColumn, 2), "{newtimestamp}", newNMS, 1), "{table_schema}", tableSchema, 1), "{table_name}", tableName, 1), "{nms}", nms, 1)
-	// log.Println(queryGen)
+	if len(schemas) == 0 {
+		return nil, fmt.Errorf("no schema matches %q", schemaList)
+	}
+	log.Printf("getSourceSchemas: %v\n", schemas)
+	return schemas, nil
+}
+
+// sourceClock is a source database's view of the current time, taken at the
+// start of a capture cycle so that window bounds never depend on the host clock.
+type sourceClock struct {
+	now        time.Time
+	replayed   time.Time
+	location   *time.Location
+	inRecovery bool
+	caughtUp   bool
+}
+
+func getSourceClock(pgDB *pgxpool.Pool) (sourceClock, error) {
+	var clock sourceClock
+	var replayed *time.Time
+	var timeZone string
+	var offsetSecs int
 	conn, err := pgDB.Acquire(context.Background())
 	if err != nil {
-		return "", fmt.Errorf("pg conn acquire error: %v", err)
+		return clock, fmt.Errorf("pg conn acquire error: %v", err)
+	}
+	defer conn.Release()
+	// a replica is only caught up while its WAL receiver streams from the
+	// primary: a stalled or disconnected receiver has replayed all it received
+	// but not what the primary has since written
+	clockQuery := `SELECT now(), pg_last_xact_replay_timestamp(), current_setting('TimeZone'), EXTRACT(TIMEZONE FROM now())::integer,
+		pg_is_in_recovery(), COALESCE(pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn(), false) AND COALESCE((
+			SELECT status = 'streaming' AND last_msg_receipt_time > now() - COALESCE(NULLIF(current_setting('wal_receiver_timeout')::interval, '0'), interval '1 minute')
+			FROM pg_stat_wal_receiver), false)`
+	err = conn.QueryRow(context.Background(), clockQuery).Scan(&clock.now, &replayed, &timeZone, &offsetSecs, &clock.inRecovery, &clock.caughtUp)
+	if err != nil {
+		return clock, fmt.Errorf("queryrow failed: source clock : %v", err)
+	}
+	if replayed != nil {
+		clock.replayed = *replayed
+	}
+	clock.location, err = time.LoadLocation(timeZone)
+	if err != nil {
+		clock.location = time.FixedZone(timeZone, offsetSecs)
+	}
+	clock.now = clock.now.In(clock.location)
+	return clock, nil
+}
+
+// replicaLag returns how far a replica's replay is behind its primary. A
+// replica streaming from its primary that has replayed all the WAL it received
+// is not lagging, however old its last replayed transaction is.
+func (clock sourceClock) replicaLag() time.Duration {
+	if !clock.inRecovery || clock.caughtUp || clock.replayed.IsZero() {
+		return 0
+	}
+	return clock.now.Sub(clock.replayed)
+}
+
+// replicaUpperBound returns the latest window upper bound a replica can serve:
+// its last replayed transaction time, or now if it is caught up and streaming,
+// less margin.
+func (clock sourceClock) replicaUpperBound(margin time.Duration) time.Time {
+	if clock.inRecovery && !clock.caughtUp && !clock.replayed.IsZero() {
+		return clock.replayed.In(clock.location).Add(-margin)
+	}
+	return clock.now.Add(-margin)
+}
+
+// sourceTime returns t in the source's timezone. Values of timestamp (without
+// time zone) columns are wall clock times in the source session's timezone.
+func (clock sourceClock) sourceTime(t time.Time, nmsType string) time.Time {
+	if nmsType == "timestamptz" {
+		return t.In(clock.location)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), clock.location)
+}
+
+// formatNMS formats a window bound for comparison with an nms column of type
+// nmsType. timestamptz bounds carry their offset; timestamp bounds are wall
+// clock times in the source session's timezone.
+func formatNMS(t time.Time, nmsType string) string {
+	if nmsType == "timestamptz" {
+		return t.Format("2006-01-02 15:04:05.999999-07:00")
+	}
+	return t.Format("2006-01-02 15:04:05.999999")
+}
+
+// nmsColumnType returns the udt_name of t's nms column from its cached table schema.
+func nmsColumnType(t table) string {
+	jsonParsed, err := gabs.ParseJSON([]byte(t.TableSchema))
+	if err != nil {
+		return ""
+	}
+	for _, column := range jsonParsed.S("columns").Children() {
+		if name, ok := column.Path("column_name").Data().(string); ok && name == t.NMSColumn {
+			udtName, _ := column.Path("udt_name").Data().(string)
+			return udtName
+		}
+	}
+	return ""
+}
+
+// pgSnapshot is an open REPEATABLE READ transaction whose snapshot is shared by
+// every table read of a source's capture cycle.
+type pgSnapshot struct {
+	conn *pgxpool.Conn
+	tx   pgx.Tx
+	id   string
+	now  time.Time
+}
+
+func exportPGSnapshot(pgDB *pgxpool.Pool) (*pgSnapshot, error) {
+	var snap pgSnapshot
+	var err error
+	snap.conn, err = pgDB.Acquire(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("pg conn acquire error: %v", err)
+	}
+	snap.tx, err = snap.conn.BeginTx(context.Background(), pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		snap.conn.Release()
+		return nil, fmt.Errorf("snapshot begin error: %v", err)
+	}
+	// the exporting transaction sits idle while table streams import its snapshot
+	_, err = snap.tx.Exec(context.Background(), "SET LOCAL idle_in_transaction_session_timeout = 0")
+	if err != nil {
+		snap.close()
+		return nil, fmt.Errorf("snapshot set timeout error: %v", err)
+	}
+	err = snap.tx.QueryRow(context.Background(), "SELECT pg_export_snapshot(), now()").Scan(&snap.id, &snap.now)
+	if err != nil {
+		snap.close()
+		return nil, fmt.Errorf("pg_export_snapshot error: %v", err)
+	}
+	log.Printf("exportPGSnapshot: snapshot %v at %v\n", snap.id, snap.now.Format("2006-01-02 15:04:05"))
+	return &snap, nil
+}
+
+func (snap *pgSnapshot) close() {
+	err := snap.tx.Rollback(context.Background())
+	if err != nil {
+		log.Printf("snapshot rollback error: %v", err)
+	}
+	snap.conn.Release()
+}
+
+// snapshotQuery wraps a table query so that it reads from the exported snapshot.
+func snapshotQuery(snapshotID, query string) string {
+	return "BEGIN TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY; SET TRANSACTION SNAPSHOT " + quoteLiteral(snapshotID) + "; " + query + "; COMMIT"
+}
+
+// pgColumn is a source table column, as listed by information_schema.columns.
+type pgColumn struct {
+	name       string
+	udtName    string
+	domainName string
+	isEnum     bool
+}
+
+func getTableColumns(tableSchema, tableName string, pgDB *pgxpool.Pool) ([]pgColumn, error) {
+	var columns []pgColumn
+	conn, err := pgDB.Acquire(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("pg conn acquire error: %v", err)
 	}
 	defer conn.Release()
-	err = conn.QueryRow(context.Background(), queryGen).Scan(&tableQuery)
+	rows, err := conn.Query(context.Background(), `SELECT c.column_name, c.udt_name, coalesce(c.domain_name, ''), coalesce(ty.typtype = 'e', false)
+	FROM information_schema.columns c
+	LEFT JOIN pg_namespace ns ON ns.nspname = c.udt_schema
+	LEFT JOIN pg_type ty ON ty.typnamespace = ns.oid AND ty.typname = c.udt_name
+	WHERE c.table_schema = $1 AND c.table_name = $2 ORDER BY c.ordinal_position`, tableSchema, tableName)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v : %v", tableName, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c pgColumn
+		err = rows.Scan(&c.name, &c.udtName, &c.domainName, &c.isEnum)
+		if err != nil {
+			return nil, fmt.Errorf("gettablecolumns() scan error: %v", err)
+		}
+		columns = append(columns, c)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("rows error: %v", rows.Err())
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns found: %v.%v", tableSchema, tableName)
+	}
+	return columns, nil
+}
+
+// getTableNMSQuery returns the query reading t's window nms > lower AND nms <= upper,
+// with its column rules, type mappings and sanitize rules applied.
+func getTableNMSQuery(t table, lower, upper string, args *queryArgs, pgDB *pgxpool.Pool) (string, error) {
+	columns, err := getTableColumns(t.Schema, t.Name, pgDB)
+	if err != nil {
+		return "", err
+	}
+	userRules, err := tableRules(t)
+	if err != nil {
+		return "", err
+	}
+	rules, mappings, sanitizeRules := userRules.columns, userRules.mappings, userRules.sanitize
+	sqlASCII, err := serverSQLASCII(sanitizeRules, pgDB)
 	if err != nil {
-		return "", fmt.Errorf("queryrow failed: %v : %v", tableName, err)
+		return "", err
 	}
+	var selectList, sanitizedFlags []string
+	for _, c := range columns {
+		if action := columnAction(rules, t, c.name); action.Action != "" {
+			expr, err := columnExpression(c, action, args)
+			if err != nil {
+				return "", fmt.Errorf("column %v: %v", c.name, err)
+			}
+			if expr != "" {
+				selectList = append(selectList, expr)
+			}
+			continue
+		}
+		ident := pgx.Identifier{c.name}.Sanitize()
+		switch mapping := columnTypeMapping(mappings, t, c.name, c.udtName, c.domainName, c.isEnum); {
+		case mapping.Expression != "":
+			selectList = append(selectList, mapping.expression(ident))
+		case isArrayType(c.udtName):
+			selectList = append(selectList, "array_to_json("+ident+") AS "+ident)
+		default:
+			expr, flag := sanitizeExpression(sanitizeRules, t, c, sqlASCII)
+			if expr == "" {
+				selectList = append(selectList, ident)
+				continue
+			}
+			selectList = append(selectList, expr)
+			sanitizedFlags = append(sanitizedFlags, flag)
+		}
+	}
+	if len(sanitizedFlags) > 0 {
+		selectList = append(selectList, sanitizedColumnExpression(sanitizedFlags))
+	}
+	nmsIdent := pgx.Identifier{t.NMSColumn}.Sanitize()
+	tableQuery := "SELECT " + strings.Join(selectList, ", ") + ", now() AS snapshot_tm FROM " + pgx.Identifier{t.Schema, t.Name}.Sanitize() +
+		" WHERE " + nmsIdent + " > " + args.add(lower) + " AND " + nmsIdent + " <= " + args.add(upper)
 	return tableQuery, nil
 }
 
-func getTablePKey(tableName string, pgDB *pgxpool.Pool) (string, error) {
-	var pKeyColumn string
+// queryArgs collects the literals of a generated query as bind parameters or,
+// for multi-statement queries which cannot take parameters, as quoted literals.
+type queryArgs struct {
+	inline bool
+	values []string
+}
+
+// add returns the placeholder or quoted literal standing for v in the query.
+func (args *queryArgs) add(v string) string {
+	if args.inline {
+		return quoteLiteral(v)
+	}
+	args.values = append(args.values, v)
+	return "$" + strconv.Itoa(len(args.values))
+}
+
+// quoteLiteral quotes s as an SQL string literal, for the statements that
+// cannot take bind parameters. It relies on standard_conforming_strings, the
+// default since PostgreSQL 9.1.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// getTablePKey returns the columns of a table's primary key in key order, or
+// none if the table has no primary key.
+func getTablePKey(tableSchema, tableName string, pgDB *pgxpool.Pool) ([]string, error) {
+	var pKeyColumns []string
 	conn, err := pgDB.Acquire(context.Background())
 	if err != nil {
-		return pKeyColumn, fmt.Errorf("pg conn acquire error: %v", err)
+		return nil, fmt.Errorf("pg conn acquire error: %v", err)
 	}
 	defer conn.Release()
-	pKeyQuery := `SELECT t.table_name, c.column_name, c.ordinal_position
-	FROM information_schema.key_column_usage AS c
-	LEFT JOIN information_schema.table_constraints AS t
-	ON t.constraint_name = c.constraint_name
-	WHERE t.table_name = ? AND t.constraint_type = 'PRIMARY KEY';`
-	err = conn.QueryRow(context.Background(), pKeyQuery, tableName).Scan(&pKeyColumn)
+	pKeyQuery := `SELECT c.column_name
+	FROM information_schema.table_constraints AS t
+	INNER JOIN information_schema.key_column_usage AS c
+	ON c.constraint_schema = t.constraint_schema AND c.constraint_name = t.constraint_name AND c.table_name = t.table_name
+	WHERE t.table_schema = $1 AND t.table_name = $2 AND t.constraint_type = 'PRIMARY KEY'
+	ORDER BY c.ordinal_position;`
+	rows, err := conn.Query(context.Background(), pKeyQuery, tableSchema, tableName)
 	if err != nil {
-		return pKeyColumn, fmt.Errorf("queryrow failed: %v : %v", tableName, err)
+		return nil, fmt.Errorf("query failed: %v : %v", tableName, err)
 	}
-	log.Printf("getTablePKey: %v primary key=%v\n", tableName, pKeyColumn)
-	return pKeyColumn, nil
+	defer rows.Close()
+	for rows.Next() {
+		var column string
+		err = rows.Scan(&column)
+		if err != nil {
+			return nil, fmt.Errorf("gettablepkey() scan error: %v", err)
+		}
+		pKeyColumns = append(pKeyColumns, column)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("rows error: %v", rows.Err())
+	}
+	log.Printf("getTablePKey: %v primary key=%v\n", tableName, pKeyColumns)
+	return pKeyColumns, nil
 }
 
-func getTableRowCount(tableName string, pgDB *pgxpool.Pool) (int64, error) {
+func getTableRowCount(tableSchema, tableName string, pgDB *pgxpool.Pool) (int64, error) {
 	var rowCount float64
 	conn, err := pgDB.Acquire(context.Background())
 	if err != nil {
@@ -142,12 +405,14 @@ func getTableRowCount(tableName string, pgDB *pgxpool.Pool) (int64, error) {
 	}
 	defer conn.Release()
 	schemaQuery := `SELECT
-	(reltuples/relpages) * (
-	  pg_relation_size('` + tableName + `') /
+	COALESCE((c.reltuples/NULLIF(c.relpages, 0)) * (
+	  pg_relation_size(c.oid) /
 	  (current_setting('block_size')::integer)
-	) AS rows
-	FROM pg_class where relname = '` + tableName + `';`
-	err = conn.QueryRow(context.Background(), schemaQuery).Scan(&rowCount)
+	), 0) AS rows
+	FROM pg_class c
+	INNER JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE n.nspname = $1 AND c.relname = $2;`
+	err = conn.QueryRow(context.Background(), schemaQuery, tableSchema, tableName).Scan(&rowCount)
 	if err != nil {
 		return 0, fmt.Errorf("queryrow failed: %v : %v", tableName, err)
 	}
@@ -155,8 +420,8 @@ func getTableRowCount(tableName string, pgDB *pgxpool.Pool) (int64, error) {
 	return rc, nil
 }
 
-func getTableSchemaJSON(tableName string, pgDB *pgxpool.Pool) (string, error) {
-	var tableSchema string
+func getTableSchemaJSON(tableSchema, tableName string, pgDB *pgxpool.Pool) (string, error) {
+	var schemaJSON string
 	// log.Printf("\ngetTableSchemaJSON: %v %v", tableName)
 	conn, err := pgDB.Acquire(context.Background())
 	if err != nil {
@@ -165,32 +430,33 @@ func getTableSchemaJSON(tableName string, pgDB *pgxpool.Pool) (string, error) {
 	defer conn.Release()
 	schemaQuery := `select row_to_json(table_schema)
 	from (
-		select t.table_name, array_agg( c ) as columns
+		select t.table_name, array_agg( c order by c.ordinal_position ) as columns
 		from information_schema.tables t
 		inner join (
-			select cl.table_name, cl.column_name, cl.udt_name, cl.is_nullable, cl.ordinal_position,cl.column_default, cl.data_type, cl.character_maximum_length, cl.numeric_precision, cl.numeric_scale, cl.numeric_precision_radix, cl.dtd_identifier, cl.is_identity
+			select cl.table_schema, cl.table_name, cl.column_name, cl.udt_name, cl.is_nullable, cl.ordinal_position,cl.column_default, cl.data_type, cl.character_maximum_length, cl.numeric_precision, cl.numeric_scale, cl.numeric_precision_radix, cl.dtd_identifier, cl.is_identity, cl.domain_name,
+				(select ty.typtype = 'e' from pg_type ty inner join pg_namespace ns on ns.oid = ty.typnamespace where ns.nspname = cl.udt_schema and ty.typname = cl.udt_name)
 			from information_schema.columns cl
-		) c (table_name,column_name,udt_name,is_nullable,ordinal_position,column_default,data_type,character_maximum_length,numeric_precision,numeric_scale,numeric_precision_radix,dtd_identifier,is_identity) on c.table_name = t.table_name
+		) c (table_schema,table_name,column_name,udt_name,is_nullable,ordinal_position,column_default,data_type,character_maximum_length,numeric_precision,numeric_scale,numeric_precision_radix,dtd_identifier,is_identity,domain_name,is_enum) on c.table_schema = t.table_schema and c.table_name = t.table_name
 		where t.table_type = 'BASE TABLE'
-		AND t.table_schema NOT IN ('pg_catalog', 'information_schema')
-		AND t.table_name = '` + tableName + `'
+		AND t.table_schema = $1
+		AND t.table_name = $2
 		group by t.table_name
 	) table_schema;`
-	err = conn.QueryRow(context.Background(), schemaQuery).Scan(&tableSchema)
+	err = conn.QueryRow(context.Background(), schemaQuery, tableSchema, tableName).Scan(&schemaJSON)
 	if err != nil {
-		return tableSchema, fmt.Errorf("queryrow failed: %v : %v", tableName, err)
+		return schemaJSON, fmt.Errorf("queryrow failed: %v : %v", tableName, err)
 	}
-	return tableSchema, nil
+	return schemaJSON, nil
 }
 
-func getTableSeedNMS(tableName, nmsColumn string, pgDB *pgxpool.Pool) (time.Time, error) {
+func getTableSeedNMS(tableSchema, tableName, nmsColumn string, pgDB *pgxpool.Pool) (time.Time, error) {
 	var nmsValue time.Time
 	conn, err := pgDB.Acquire(context.Background())
 	if err != nil {
 		return nmsValue, fmt.Errorf("pg conn acquire error: %v", err)
 	}
 	defer conn.Release()
-	err = conn.QueryRow(context.Background(), "SELECT MIN("+nmsColumn+") FROM "+tableName).Scan(&nmsValue)
+	err = conn.QueryRow(context.Background(), "SELECT MIN("+pgx.Identifier{nmsColumn}.Sanitize()+") FROM "+pgx.Identifier{tableSchema, tableName}.Sanitize()).Scan(&nmsValue)
 	if err != nil {
 		return nmsValue, fmt.Errorf("queryrow failed: %v : %v", tableName, err)
 	}
@@ -198,14 +464,16 @@ func getTableSeedNMS(tableName, nmsColumn string, pgDB *pgxpool.Pool) (time.Time
 	return nmsValue, nil
 }
 
-func getTablesWithNMS(tableSchema, nmsColumn string, dsnEnum int64, pgUnlogged []string, pgDB *pgxpool.Pool, nmsDB *sql.DB) ([]pgTable, error) {
+// getTablesWithNMS returns the tables of tableSchema having an nmsColumn, with
+// the metadata they are seeded with.
+func getTablesWithNMS(tableSchema, nmsColumn string, dsnEnum int64, pgUnlogged []string, pgDB *pgxpool.Pool) ([]pgTable, error) {
 	var pgNMSTables []pgTable
 	conn, err := pgDB.Acquire(context.Background())
 	if err != nil {
 		return nil, fmt.Errorf("pg conn acquire error: %v", err)
 	}
 	defer conn.Release()
-	rows, err := conn.Query(context.Background(), "SELECT table_name FROM information_schema.columns WHERE table_schema = '"+tableSchema+"' AND column_name = '"+nmsColumn+"'")
+	rows, err := conn.Query(context.Background(), "SELECT table_name FROM information_schema.columns WHERE table_schema = $1 AND column_name = $2", tableSchema, nmsColumn)
 	if err != nil {
 		conn.Release()
 		return pgNMSTables, fmt.Errorf("query error: %v", err)
@@ -224,42 +492,37 @@ func getTablesWithNMS(tableSchema, nmsColumn string, dsnEnum int64, pgUnlogged [
 		table.dsnEnum = dsnEnum
 		pgNMSTables = append(pgNMSTables, table)
 	}
-	// temporary: remove unlogged tables from list of tables to scan
-	for i, table := range pgNMSTables {
-		var tableName string
-		var empty pgTable
-		tableName = table.name
-		if sugar.Contains(pgUnlogged, tableName) {
-			pgNMSTables[i] = pgNMSTables[len(pgNMSTables)-1]
-			pgNMSTables[len(pgNMSTables)-1] = empty
-			pgNMSTables = pgNMSTables[:len(pgNMSTables)-1]
+	// unlogged tables are empty placeholders on replicas, remove them from the list of tables to scan
+	logged := pgNMSTables[:0]
+	for _, table := range pgNMSTables {
+		if sugar.Contains(pgUnlogged, table.schema+"."+table.name) {
+			log.Printf("getTablesWithNMS: skipping unlogged table %v\n", table.name)
+			continue
 		}
+		logged = append(logged, table)
 	}
-	for i, table := range pgNMSTables {
-		pgNMSTables[i].nmsTime, err = getTableSeedNMS(table.name, table.nmsColumn, pgDB)
+	pgNMSTables = logged
+	seedable := pgNMSTables[:0]
+	for _, table := range pgNMSTables {
+		table.nmsTime, err = getTableSeedNMS(table.schema, table.name, table.nmsColumn, pgDB)
 		if err != nil {
 			continue
 		}
-		pgNMSTables[i].tableSchema, err = getTableSchemaJSON(table.name, pgDB)
+		table.tableSchema, err = getTableSchemaJSON(table.schema, table.name, pgDB)
 		if err != nil {
 			continue
 		}
-		pgNMSTables[i].rowCount, err = getTableRowCount(table.name, pgDB)
+		table.rowCount, err = getTableRowCount(table.schema, table.name, pgDB)
 		if err != nil {
 			continue
 		}
-		pgNMSTables[i].pKeyColumn, err = getTablePKey(table.name, pgDB)
+		table.pKeyColumns, err = getTablePKey(table.schema, table.name, pgDB)
 		if err != nil {
 			continue
 		}
-
-		err := seedNMSTable(pgNMSTables[i], nmsDB)
-		if err != nil {
-			log.Printf("seednmstable() error: %v", err)
-			continue
-			// return nil, fmt.Errorf("gettableschemajson() error: %v", err)
-		}
+		seedable = append(seedable, table)
 	}
+	pgNMSTables = seedable
 
 	if rows.Err() != nil {
 		return nil, fmt.Errorf("rows error: %v", rows.Err())
@@ -274,11 +537,11 @@ func getUnloggedTables(pgDB *pgxpool.Pool) ([]string, error) {
 	if err != nil {
 		return nil, fmt.Errorf("pg conn acquire error: %v", err)
 	}
-	rows, err := conn.Query(context.Background(), "select relname from pg_class where relpersistence='u'")
+	defer conn.Release()
+	rows, err := conn.Query(context.Background(), "select n.nspname || '.' || c.relname from pg_class c inner join pg_namespace n on n.oid = c.relnamespace where c.relpersistence = 'u'")
 	if err != nil {
 		return nil, fmt.Errorf("query error: %v", err)
 	}
-	defer conn.Release()
 	defer rows.Close()
 	for rows.Next() {
 		var tableName string
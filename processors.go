@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"gopkg.in/yaml.v3"
+)
+
+// tableProcessorYAML returns the user processors applied to t's rows, those of
+// BENTHOS_PROCESSOR_CONF_FILE followed by those of t's processor_conf_file.
+func tableProcessorYAML(t table) ([]string, error) {
+	var processors []string
+	for _, file := range []string{os.Getenv("BENTHOS_PROCESSOR_CONF_FILE"), t.ProcessorConfFile} {
+		if file == "" {
+			continue
+		}
+		p, err := loadProcessorFile(file, t)
+		if err != nil {
+			return nil, err
+		}
+		processors = append(processors, p...)
+	}
+	return processors, nil
+}
+
+// loadProcessorFile reads a YAML list of Benthos processors, filling the table
+// template variables for t, and returns the YAML of each processor.
+func loadProcessorFile(file string, t table) ([]string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("processor file read error: %v", err)
+	}
+	var nodes []yaml.Node
+	err = yaml.Unmarshal([]byte(tableTemplateVars(t).Replace(string(b))), &nodes)
+	if err != nil {
+		return nil, fmt.Errorf("processor file %v parse error, expecting a list of processors: %v", file, err)
+	}
+	var processors []string
+	for _, node := range nodes {
+		p, err := yaml.Marshal(&node)
+		if err != nil {
+			return nil, fmt.Errorf("processor file %v marshal error: %v", file, err)
+		}
+		processors = append(processors, string(p))
+	}
+	return processors, nil
+}
+
+// lintUserConfigs checks the user processors and output of every table with
+// the Benthos linter, so that a bad config fails at startup rather than on
+// capture.
+func lintUserConfigs(tables []table) error {
+	var errs []string
+	for _, t := range tables {
+		processors, err := tableProcessorYAML(t)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v.%v.%v: %v", t.DSNEnum, t.Schema, t.Name, err))
+			continue
+		}
+		builder := service.NewStreamBuilder()
+		for _, p := range processors {
+			err = builder.AddProcessorYAML(p)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%v.%v.%v: %v", t.DSNEnum, t.Schema, t.Name, err))
+			}
+		}
+		if os.Getenv("OUTPUT_TYPE") == "BENTHOS" {
+			outputYAML, err := newBenthosOutputConfig(t)
+			if err == nil {
+				err = builder.AddOutputYAML(outputYAML)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%v.%v.%v output: %v", t.DSNEnum, t.Schema, t.Name, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("benthos config errors: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// validateUserConfigs checks the user rule files and lints the user Benthos
+// configs of every seeded table.
+func validateUserConfigs() error {
+	rules, err := loadUserRules()
+	if err != nil {
+		return fmt.Errorf("validateuserconfigs rules error: %v", err)
+	}
+	nmsDB, err := nmsDBOpen()
+	if err != nil {
+		return fmt.Errorf("validateuserconfigs nmsdbopen error: %v", err)
+	}
+	defer nmsDB.Close()
+	tables, err := nmsTablesQuery(nmsDB, false)
+	if err != nil {
+		return fmt.Errorf("validateuserconfigs nmstablesquery error: %v", err)
+	}
+	return lintUserConfigs(withRules(tables, rules))
+}
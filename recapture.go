@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// recapture is a window of a table queued in nmsrecaptures to be captured
+// again, nms > from AND nms <= to, to its sink or to sinkTable.
+type recapture struct {
+	id        int
+	from      time.Time
+	to        time.Time
+	sinkTable string
+}
+
+// queueRecapture queues t's window from, to to be captured again after t's
+// next window.
+func queueRecapture(nmsDB *sql.DB, t table, from, to time.Time, reason string) error {
+	insertQuery := `
+	INSERT INTO nmsrecaptures
+	(table_id, window_start, window_end, reason, queued_on)
+	VALUES (?, ?, ?, ?, datetime('now'))`
+	_, err := nmsDB.Exec(insertQuery, t.ID, from, to, reason)
+	if err != nil {
+		return fmt.Errorf("queuerecapture() exec error: %v", err)
+	}
+	return nil
+}
+
+// resetInterruptedRecaptures queues again the recaptures started by a capture
+// that stopped before recording their outcome. It runs before capturing, while
+// no other capture can hold them. Backfill jobs are run by their command, which
+// reports their failure, and are left alone.
+func resetInterruptedRecaptures() error {
+	nmsDB, err := nmsDBOpen()
+	if err != nil {
+		return fmt.Errorf("resetinterruptedrecaptures() nmsdbopen error: %v", err)
+	}
+	defer nmsDB.Close()
+	result, err := nmsDB.Exec("UPDATE nmsrecaptures SET started_on = NULL, error = 'interrupted' WHERE started_on IS NOT NULL AND captured_on IS NULL AND coalesce(reason, '') != 'backfill'")
+	if err != nil {
+		return fmt.Errorf("resetinterruptedrecaptures() exec error: %v", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		log.Printf("recapture: %v interrupted recaptures queued again\n", n)
+	}
+	return nil
+}
+
+func pendingRecaptures(nmsDB *sql.DB, t table) ([]recapture, error) {
+	var recaptures []recapture
+	rows, err := nmsDB.Query("SELECT id, window_start, window_end, coalesce(sink_table, '') FROM nmsrecaptures WHERE table_id = ? AND started_on IS NULL AND captured_on IS NULL ORDER BY id", t.ID)
+	if err != nil {
+		return nil, fmt.Errorf("pendingrecaptures() query error: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r recapture
+		err = rows.Scan(&r.id, &r.from, &r.to, &r.sinkTable)
+		if err != nil {
+			return nil, fmt.Errorf("pendingrecaptures() scan error: %v", err)
+		}
+		recaptures = append(recaptures, r)
+	}
+	return recaptures, rows.Err()
+}
+
+// startRecapture records t's window r, captured right away, and returns its id.
+func startRecapture(nmsDB *sql.DB, t table, r recapture, reason string) (int, error) {
+	insertQuery := `
+	INSERT INTO nmsrecaptures
+	(table_id, window_start, window_end, reason, queued_on, sink_table, started_on)
+	VALUES (?, ?, ?, ?, datetime('now'), ?, datetime('now'))`
+	result, err := nmsDB.Exec(insertQuery, t.ID, r.from, r.to, reason, sql.NullString{String: r.sinkTable, Valid: r.sinkTable != ""})
+	if err != nil {
+		return 0, fmt.Errorf("startrecapture() exec error: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("startrecapture() id error: %v", err)
+	}
+	return int(id), nil
+}
+
+// finishRecapture records the outcome of recapture id. A failed queued
+// recapture is queued again when retry is set.
+func finishRecapture(nmsDB *sql.DB, id int, captureErr error, retry bool) error {
+	var err error
+	switch {
+	case captureErr == nil:
+		_, err = nmsDB.Exec("UPDATE nmsrecaptures SET captured_on = datetime('now'), error = NULL WHERE id = ?", id)
+	case retry:
+		_, err = nmsDB.Exec("UPDATE nmsrecaptures SET started_on = NULL, error = ? WHERE id = ?", captureErr.Error(), id)
+	default:
+		_, err = nmsDB.Exec("UPDATE nmsrecaptures SET error = ? WHERE id = ?", captureErr.Error(), id)
+	}
+	if err != nil {
+		return fmt.Errorf("finishrecapture() exec error: %v", err)
+	}
+	return nil
+}
+
+// runRecaptures captures t's queued windows again, each in its own stream,
+// without moving t's nms. Failed windows stay queued.
+func runRecaptures(dbURL string, t table, pgPool *pgxpool.Pool, nmsDB *sql.DB) {
+	recaptures, err := pendingRecaptures(nmsDB, t)
+	if err != nil {
+		log.Printf("recapture queue error: %v.%v - %v", t.DSNEnum, t.Name, err)
+		return
+	}
+	for _, r := range recaptures {
+		log.Printf("recapture table %v.%v\tfrom: %v\tto: %v\n", t.DSNEnum, t.Name, r.from.Format("2006-01-02 15:04:05"), r.to.Format("2006-01-02 15:04:05"))
+		_, err = nmsDB.Exec("UPDATE nmsrecaptures SET started_on = datetime('now') WHERE id = ?", r.id)
+		if err != nil {
+			log.Printf("recapture update error: id:%v - %v", r.id, err)
+			continue
+		}
+		captureErr := captureRange(dbURL, t, r, pgPool, nmsDB)
+		if captureErr != nil {
+			log.Printf("recapture failure: %v.%v id:%v - %v", t.DSNEnum, t.Name, r.id, captureErr)
+		}
+		err = finishRecapture(nmsDB, r.id, captureErr, true)
+		if err != nil {
+			log.Printf("recapture update error: id:%v - %v", r.id, err)
+		}
+	}
+}
+
+// captureRange captures t's rows with nms > r.from AND nms <= r.to to its sink,
+// or to r's sink table, and records the window in the run history.
+func captureRange(dbURL string, t table, r recapture, pgPool *pgxpool.Pool, nmsDB *sql.DB) error {
+	clock, err := getSourceClock(pgPool)
+	if err != nil {
+		return fmt.Errorf("getsourceclock error: %v", err)
+	}
+	nmsType := nmsColumnType(t)
+	t.recaptureID = r.id
+	t.stagingTable = r.sinkTable
+	if t.stagingTable != "" && os.Getenv("OUTPUT_TYPE") == "BQ" {
+		err = createBigQueryStagingTable(t)
+		if err != nil {
+			return fmt.Errorf("staging table create error: %v", err)
+		}
+	}
+	t.NMS = clock.sourceTime(r.from, nmsType)
+	t.NewNMS = clock.sourceTime(r.to, nmsType)
+	args := &queryArgs{}
+	t.Query, err = getTableNMSQuery(t, formatNMS(t.NMS, nmsType), formatNMS(t.NewNMS, nmsType), args, pgPool)
+	if err != nil {
+		return fmt.Errorf("gettablenmsquery error: %v", err)
+	}
+	t.QueryArgs = args.values
+	t.capturedFrom = clock.now
+	t.stream, err = newStream(dbURL, t)
+	if err != nil {
+		return fmt.Errorf("newstream error: %v", err)
+	}
+	err = t.stream.Run(context.Background())
+	sanitized := sanitizedValues(t)
+	if len(sanitized) > 0 {
+		log.Printf("sanitized values: %v.%v recapture id:%v - %v", t.DSNEnum, t.Name, r.id, sanitized)
+	}
+	if err != nil {
+		return fmt.Errorf("stream failure: %v", err)
+	}
+	err = publishWindow(&t)
+	if err != nil {
+		return err
+	}
+	return insertRun(t, sanitized, nmsDB)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/benthosdev/benthos/v4/public/service"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/cast"
+)
+
+// sanitizeRule replaces the invalid values found by its check in the columns
+// matching its source, schema, table, column and type globs:
+//   - infinity: 'infinity' and '-infinity' dates, timestamps and floats
+//   - out_of_range: dates and timestamps before min or after max
+//   - nan: 'NaN' numerics and floats
+//   - invalid_utf8: text that isn't valid UTF-8, only found in SQL_ASCII databases
+//
+// Action is one of:
+//   - null: the value is replaced by NULL
+//   - clamp: the value is replaced by min or max (infinity and out_of_range only)
+//   - replace: the value is replaced by value
+type sanitizeRule struct {
+	DSN    int64  `json:"dsn"`
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	Type   string `json:"type"`
+	Check  string `json:"check"`
+	Action string `json:"action"`
+	Min    string `json:"min"`
+	Max    string `json:"max"`
+	Value  string `json:"value"`
+}
+
+// sanitizeChecks lists the checks in the order they are evaluated, with the
+// column types they apply to.
+var sanitizeChecks = []struct {
+	name  string
+	types []string
+}{
+	{"infinity", []string{"date", "timestamp", "timestamptz", "float4", "float8"}},
+	{"out_of_range", []string{"date", "timestamp", "timestamptz"}},
+	{"nan", []string{"numeric", "float4", "float8"}},
+	{"invalid_utf8", []string{"text", "varchar", "bpchar"}},
+}
+
+// utf8Pattern matches valid UTF-8 byte sequences, in SQL_ASCII databases
+// where each byte is a character.
+const utf8Pattern = `^(?:[\x01-\x7F]|[\xC2-\xDF][\x80-\xBF]|\xE0[\xA0-\xBF][\x80-\xBF]|[\xE1-\xEC\xEE\xEF][\x80-\xBF]{2}|\xED[\x80-\x9F][\x80-\xBF]|\xF0[\x90-\xBF][\x80-\xBF]{2}|[\xF1-\xF3][\x80-\xBF]{3}|\xF4[\x80-\x8F][\x80-\xBF]{2})*$`
+
+// sanitizedColumn lists the sanitized values of a captured row, it is removed
+// by the leftshove_sanitized processor.
+const sanitizedColumn = "_leftshove_sanitized"
+
+// loadSanitizeRules reads the rules of the SANITIZE_RULES_FILE JSON array.
+func loadSanitizeRules() ([]sanitizeRule, error) {
+	var rules []sanitizeRule
+	rulesFile := os.Getenv("SANITIZE_RULES_FILE")
+	if rulesFile == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(rulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("sanitize rules file read error: %v", err)
+	}
+	err = json.Unmarshal(b, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("sanitize rules file parse error: %v", err)
+	}
+	for _, r := range rules {
+		if sanitizeCheckTypes(r.Check) == nil {
+			return nil, fmt.Errorf("sanitize rule %+v: unknown check %q", r, r.Check)
+		}
+		switch r.Action {
+		case "null", "replace":
+		case "clamp":
+			if r.Check == "infinity" && (r.Min == "" || r.Max == "") {
+				return nil, fmt.Errorf("sanitize rule %+v: clamp requires min and max", r)
+			}
+			if r.Check != "infinity" && r.Check != "out_of_range" {
+				return nil, fmt.Errorf("sanitize rule %+v: clamp only applies to infinity and out_of_range", r)
+			}
+		default:
+			return nil, fmt.Errorf("sanitize rule %+v: unknown action %q", r, r.Action)
+		}
+		if r.Check == "out_of_range" && r.Min == "" && r.Max == "" {
+			return nil, fmt.Errorf("sanitize rule %+v: out_of_range requires min or max", r)
+		}
+	}
+	return rules, nil
+}
+
+func sanitizeCheckTypes(check string) []string {
+	for _, c := range sanitizeChecks {
+		if c.name == check {
+			return c.types
+		}
+	}
+	return nil
+}
+
+func (r sanitizeRule) matches(t table, c pgColumn) bool {
+	if !(r.DSN == 0 || r.DSN == t.DSNEnum) || !globMatch(r.Schema, t.Schema) || !globMatch(r.Table, t.Name) || !globMatch(r.Column, c.name) {
+		return false
+	}
+	if r.Type != "" && !globMatch(r.Type, c.udtName) && !(c.domainName != "" && globMatch(r.Type, c.domainName)) {
+		return false
+	}
+	for _, udtName := range sanitizeCheckTypes(r.Check) {
+		if c.udtName == udtName {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeBranch replaces the column by value when cond is true.
+type sanitizeBranch struct {
+	cond  string
+	value string
+}
+
+// branches returns the CASE branches of the rule for column ident of type udtName.
+func (r sanitizeRule) branches(ident, udtName string) []sanitizeBranch {
+	literal := func(v string) string {
+		return quoteLiteral(v) + "::" + udtName
+	}
+	value := "NULL"
+	if r.Action == "replace" {
+		value = literal(r.Value)
+	}
+	switch r.Check {
+	case "infinity":
+		if r.Action == "clamp" {
+			return []sanitizeBranch{
+				{ident + " = 'infinity'", literal(r.Max)},
+				{ident + " = '-infinity'", literal(r.Min)},
+			}
+		}
+		return []sanitizeBranch{{ident + " IN ('infinity', '-infinity')", value}}
+	case "out_of_range":
+		below, above := value, value
+		if r.Action == "clamp" {
+			below, above = literal(r.Min), literal(r.Max)
+		}
+		var branches []sanitizeBranch
+		if r.Min != "" {
+			branches = append(branches, sanitizeBranch{ident + " < " + literal(r.Min), below})
+		}
+		if r.Max != "" {
+			branches = append(branches, sanitizeBranch{ident + " > " + literal(r.Max), above})
+		}
+		return branches
+	case "nan":
+		return []sanitizeBranch{{ident + " = 'NaN'", value}}
+	case "invalid_utf8":
+		return []sanitizeBranch{{ident + " !~ " + quoteLiteral(utf8Pattern), value}}
+	}
+	return nil
+}
+
+// sanitizeExpression returns the select list expression sanitizing column c
+// with the first matching rule of each check, and the expression naming the
+// check that replaced its value, or empty strings if no rule applies.
+func sanitizeExpression(rules []sanitizeRule, t table, c pgColumn, sqlASCII bool) (string, string) {
+	ident := pgx.Identifier{c.name}.Sanitize()
+	var valueCase, flagCase []string
+	for _, check := range sanitizeChecks {
+		if check.name == "invalid_utf8" && !sqlASCII {
+			// text is validated on input by other server encodings
+			continue
+		}
+		for _, r := range rules {
+			if r.Check != check.name || !r.matches(t, c) {
+				continue
+			}
+			for _, b := range r.branches(ident, c.udtName) {
+				valueCase = append(valueCase, "WHEN "+b.cond+" THEN "+b.value)
+				flagCase = append(flagCase, "WHEN "+b.cond+" THEN "+quoteLiteral(c.name+":"+check.name))
+			}
+			break
+		}
+	}
+	if len(valueCase) == 0 {
+		return "", ""
+	}
+	return "CASE " + strings.Join(valueCase, " ") + " ELSE " + ident + " END AS " + ident,
+		"CASE " + strings.Join(flagCase, " ") + " END"
+}
+
+// sanitizedColumnExpression returns the select list expression listing the
+// sanitized values of a row as a JSON array.
+func sanitizedColumnExpression(flags []string) string {
+	return "array_to_json(array_remove(ARRAY[" + strings.Join(flags, ", ") + "], NULL)) AS " + sanitizedColumn
+}
+
+// serverSQLASCII reports whether the source database has the SQL_ASCII
+// encoding, which stores text bytes unvalidated.
+func serverSQLASCII(rules []sanitizeRule, pgDB *pgxpool.Pool) (bool, error) {
+	for _, r := range rules {
+		if r.Check != "invalid_utf8" {
+			continue
+		}
+		var encoding string
+		err := pgDB.QueryRow(context.Background(), "SHOW server_encoding").Scan(&encoding)
+		if err != nil {
+			return false, fmt.Errorf("server encoding query error: %v", err)
+		}
+		return encoding == "SQL_ASCII", nil
+	}
+	return false, nil
+}
+
+// sanitizedCounts counts the sanitized values of the current window by table
+// key and column:check.
+var sanitizedCounts = struct {
+	sync.Mutex
+	count map[string]map[string]int
+}{
+	count: make(map[string]map[string]int),
+}
+
+// sanitizedValues returns the counts of values sanitized in t's window by
+// column:check, and resets them for the next window.
+func sanitizedValues(t table) map[string]int {
+	sanitizedCounts.Lock()
+	defer sanitizedCounts.Unlock()
+	counts := sanitizedCounts.count[deliveredTableKey(t)]
+	delete(sanitizedCounts.count, deliveredTableKey(t))
+	return counts
+}
+
+func init() {
+	spec := service.NewConfigSpec().
+		Summary("Counts the sanitized values of captured rows and removes their list.").
+		Field(service.NewStringField("table"))
+	err := service.RegisterProcessor("leftshove_sanitized", spec, func(conf *service.ParsedConfig, mgr *service.Resources) (service.Processor, error) {
+		table, err := conf.FieldString("table")
+		if err != nil {
+			return nil, err
+		}
+		return &sanitizedProcessor{table: table}, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+type sanitizedProcessor struct {
+	table string
+}
+
+func (p *sanitizedProcessor) Process(ctx context.Context, msg *service.Message) (service.MessageBatch, error) {
+	structured, err := msg.AsStructuredMut()
+	if err != nil {
+		return nil, fmt.Errorf("sanitized message read error: %v", err)
+	}
+	row, ok := structured.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("sanitized message is not an object: %T", structured)
+	}
+	flags, ok := row[sanitizedColumn]
+	if !ok {
+		return service.MessageBatch{msg}, nil
+	}
+	delete(row, sanitizedColumn)
+	msg.SetStructuredMut(row)
+	var sanitized []string
+	if s, ok := flags.(string); ok && s != "" {
+		err = json.Unmarshal([]byte(s), &sanitized)
+		if err != nil {
+			return nil, fmt.Errorf("sanitized values parse error: %v", err)
+		}
+	}
+	if len(sanitized) > 0 {
+		sanitizedCounts.Lock()
+		counts := sanitizedCounts.count[p.table]
+		if counts == nil {
+			counts = make(map[string]int)
+			sanitizedCounts.count[p.table] = counts
+		}
+		for _, v := range sanitized {
+			counts[v]++
+		}
+		sanitizedCounts.Unlock()
+	}
+	return service.MessageBatch{msg}, nil
+}
+
+func (p *sanitizedProcessor) Close(ctx context.Context) error {
+	return nil
+}
+
+// newSanitizedProcessor returns the processor counting the sanitized values
+// of t's rows, or an empty string if no sanitize rules are set.
+func newSanitizedProcessor(t table) (string, error) {
+	rules, err := tableRules(t)
+	if err != nil || len(rules.sanitize) == 0 {
+		return "", err
+	}
+	return strings.Replace(`leftshove_sanitized:
+  table: {tableKey}`, "{tableKey}", yamlString(deliveredTableKey(t)), 1), nil
+}
+
+// checkMungeEnv returns an error naming the sanitize rules replacing the
+// removed MUNGE_* env vars if any is set, as their timestamps would otherwise
+// silently stop being munged.
+func checkMungeEnv() error {
+	var set []string
+	for _, kv := range os.Environ() {
+		if name, value, _ := strings.Cut(kv, "="); strings.HasPrefix(name, "MUNGE_") && value != "" {
+			set = append(set, name)
+		}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	rule := map[string]string{"type": "timestamp*", "check": "out_of_range", "action": "null", "min": "1970-01-01 00:00:00"}
+	if minTime := cast.ToTime(os.Getenv("MUNGE_MIN_TIMESTAMP")); !minTime.IsZero() && cast.ToBool(os.Getenv("MUNGE_TIMESTAMPS_BEFORE_MIN")) {
+		rule["min"] = minTime.Format("2006-01-02 15:04:05")
+	}
+	if cast.ToBool(os.Getenv("MUNGE_INVALID_TIMESTAMPS_TO_MIN")) {
+		rule["action"] = "clamp"
+		if minTime := cast.ToTime(os.Getenv("MUNGE_MIN_TIMESTAMP")); !minTime.IsZero() {
+			rule["min"] = minTime.Format("2006-01-02 15:04:05")
+		}
+	}
+	b, err := json.Marshal(rule)
+	if err != nil {
+		return fmt.Errorf("munge rule marshal error: %v", err)
+	}
+	return fmt.Errorf("%v are no longer supported, unset them and add the equivalent rule to the SANITIZE_RULES_FILE JSON array (see sanitize_rules.sample.json): %s", strings.Join(set, ", "), b)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/cast"
+)
+
+// scheduledTable is a table waiting in the capture queue.
+type scheduledTable struct {
+	id    int
+	name  string
+	due   time.Time
+	lag   time.Duration
+	index int
+}
+
+// captureQueue is a priority queue of due tables, the most lagging table first.
+type captureQueue []*scheduledTable
+
+func (q captureQueue) Len() int { return len(q) }
+
+func (q captureQueue) Less(i, j int) bool { return q[i].lag > q[j].lag }
+
+func (q captureQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *captureQueue) Push(x any) {
+	item := x.(*scheduledTable)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *captureQueue) Pop() any {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*q = old[:n-1]
+	return item
+}
+
+// runScheduler captures tables as they fall due until the process is stopped.
+func runScheduler() error {
+	maxIdle := time.Second * time.Duration(cast.ToInt64(os.Getenv("CDC_MAX_IDLE_SECS")))
+	if maxIdle <= 0 {
+		maxIdle = time.Minute
+	}
+	// tables skipped or failed by a cycle keep their last_shoved_on, so remember
+	// attempts to keep them from being retried in a tight loop
+	attempted := make(map[int]time.Time)
+	for {
+		nmsDB, err := nmsDBOpen()
+		if err != nil {
+			return fmt.Errorf("scheduler nmsdbopen error: %v", err)
+		}
+		tables, err := nmsTablesQuery(nmsDB, false)
+		nmsDB.Close()
+		if err != nil {
+			return fmt.Errorf("scheduler nmstablesquery error: %v", err)
+		}
+
+		currentTime := time.Now()
+		q := &captureQueue{}
+		nextDue := currentTime.Add(maxIdle)
+		for _, t := range tables {
+			last := t.LastShove
+			if attempted[t.ID].After(last) {
+				last = attempted[t.ID]
+			}
+			due, err := nextCaptureTime(t, last)
+			if err != nil {
+				log.Printf("scheduler table(%v) %v: %v", t.ID, t.Name, err)
+				continue
+			}
+			if due.After(currentTime) {
+				if due.Before(nextDue) {
+					nextDue = due
+				}
+				continue
+			}
+			heap.Push(q, &scheduledTable{id: t.ID, name: t.Name, due: due, lag: currentTime.Sub(t.NMS)})
+		}
+
+		if q.Len() == 0 {
+			idle := time.Until(nextDue)
+			log.Printf("scheduler: no tables due, sleeping %v\n", idle.Round(time.Second))
+			time.Sleep(idle)
+			continue
+		}
+
+		var due []int
+		for q.Len() > 0 {
+			item := heap.Pop(q).(*scheduledTable)
+			log.Printf("scheduler: table(%v) %v due %v lag %v\n", item.id, item.name, item.due.Format("2006-01-02 15:04:05"), item.lag.Round(time.Second))
+			due = append(due, item.id)
+			attempted[item.id] = currentTime
+		}
+		err = cdc(due)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// nextCaptureTime returns when t should next be captured after last. Per-table
+// settings take precedence over the source's PG_CAPTURE_CRON_N and
+// PG_CAPTURE_INTERVAL_SECS_N, which in turn fall back to CDC_INTERVAL_SECS.
+func nextCaptureTime(t table, last time.Time) (time.Time, error) {
+	if last.IsZero() {
+		return last, nil
+	}
+	cronSpec := t.CaptureCron
+	if cronSpec == "" && t.CaptureInterval <= 0 {
+		cronSpec = os.Getenv("PG_CAPTURE_CRON_" + cast.ToString(t.DSNEnum))
+	}
+	if cronSpec != "" {
+		schedule, err := cron.ParseStandard(cronSpec)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid capture cron %q: %v", cronSpec, err)
+		}
+		return schedule.Next(last), nil
+	}
+	interval := t.CaptureInterval
+	if interval <= 0 {
+		interval = cast.ToInt64(os.Getenv("PG_CAPTURE_INTERVAL_SECS_" + cast.ToString(t.DSNEnum)))
+	}
+	if interval <= 0 {
+		interval = cast.ToInt64(os.Getenv("CDC_INTERVAL_SECS"))
+	}
+	if interval <= 0 {
+		interval = 60
+	}
+	return last.Add(time.Second * time.Duration(interval)), nil
+}
+
+// sourceTables returns the tables of tables captured from source dsnEnum.
+func sourceTables(tables []table, dsnEnum int64) []table {
+	var selected []table
+	for _, t := range tables {
+		if t.DSNEnum == dsnEnum {
+			selected = append(selected, t)
+		}
+	}
+	return selected
+}
+
+// scheduledTables returns the tables whose ids are in due, in the order of due.
+// A nil due selects every table.
+func scheduledTables(tables []table, due []int) []table {
+	if due == nil {
+		return tables
+	}
+	byID := make(map[int]table, len(tables))
+	for _, t := range tables {
+		byID[t.ID] = t
+	}
+	var selected []table
+	for _, id := range due {
+		if t, ok := byID[id]; ok {
+			selected = append(selected, t)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// registerAvroSchema registers schema under subject and returns its schema id.
+// A schema that isn't backward compatible with the subject's latest version is
+// rejected before it is published. Schemas are registered with the Confluent
+// compatible registry at SCHEMA_REGISTRY_URL (credentials as URL user info), or
+// in the local registry file ./sqlite/schema_registry.json when it is unset.
+func registerAvroSchema(subject, schema string) (int, error) {
+	if registryURL := os.Getenv("SCHEMA_REGISTRY_URL"); registryURL != "" {
+		return confluentRegisterSchema(strings.TrimSuffix(registryURL, "/"), subject, schema)
+	}
+	return localRegisterSchema("./sqlite/schema_registry.json", subject, schema)
+}
+
+var schemaRegistryClient = &http.Client{Timeout: 30 * time.Second}
+
+// schemaRegistryPost posts schema to the registry path and decodes the response
+// into out, returning the response status.
+func schemaRegistryPost(endpoint, schema string, out any) (int, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := schemaRegistryClient.Post(endpoint, "application/vnd.schemaregistry.v1+json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("schema registry status %v: %s", resp.StatusCode, b)
+	}
+	return resp.StatusCode, json.Unmarshal(b, out)
+}
+
+func confluentRegisterSchema(registryURL, subject, schema string) (int, error) {
+	var compatibility struct {
+		IsCompatible bool     `json:"is_compatible"`
+		Messages     []string `json:"messages"`
+	}
+	status, err := schemaRegistryPost(registryURL+"/compatibility/subjects/"+url.PathEscape(subject)+"/versions/latest?verbose=true", schema, &compatibility)
+	switch {
+	case status == http.StatusNotFound:
+		// first version of the subject
+	case err != nil:
+		return 0, fmt.Errorf("schema registry compatibility check error: %v", err)
+	case !compatibility.IsCompatible:
+		return 0, fmt.Errorf("schema for subject %v is incompatible with its latest version: %v", subject, strings.Join(compatibility.Messages, "; "))
+	}
+	var registered struct {
+		ID int `json:"id"`
+	}
+	_, err = schemaRegistryPost(registryURL+"/subjects/"+url.PathEscape(subject)+"/versions", schema, &registered)
+	if err != nil {
+		return 0, fmt.Errorf("schema registry register error: %v", err)
+	}
+	return registered.ID, nil
+}
+
+// localSchema is a schema version of the local registry file.
+type localSchema struct {
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+	ID      int    `json:"id"`
+	Schema  string `json:"schema"`
+}
+
+var localRegistryLock sync.Mutex
+
+// localRegisterSchema registers schema in the registry file path, ids are
+// shared by subjects registering the same schema like in a Confluent registry.
+func localRegisterSchema(path, subject, schema string) (int, error) {
+	localRegistryLock.Lock()
+	defer localRegistryLock.Unlock()
+	var schemas []localSchema
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("schema registry file read error: %v", err)
+	}
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &schemas)
+		if err != nil {
+			return 0, fmt.Errorf("schema registry file parse error: %v", err)
+		}
+	}
+	var latest *localSchema
+	id, maxID := 0, 0
+	for i, s := range schemas {
+		if s.Subject == subject && (latest == nil || s.Version > latest.Version) {
+			latest = &schemas[i]
+		}
+		if s.Schema == schema {
+			id = s.ID
+		}
+		maxID = max(maxID, s.ID)
+	}
+	if latest != nil && latest.Schema == schema {
+		return latest.ID, nil
+	}
+	version := 1
+	if latest != nil {
+		err = avroBackwardCompatible(latest.Schema, schema)
+		if err != nil {
+			return 0, fmt.Errorf("schema for subject %v is incompatible with its latest version: %v", subject, err)
+		}
+		version = latest.Version + 1
+	}
+	if id == 0 {
+		id = maxID + 1
+	}
+	schemas = append(schemas, localSchema{Subject: subject, Version: version, ID: id, Schema: schema})
+	b, err = json.MarshalIndent(schemas, "", "  ")
+	if err != nil {
+		return 0, fmt.Errorf("schema registry file marshal error: %v", err)
+	}
+	err = os.MkdirAll("sqlite", 0755)
+	if err != nil {
+		return 0, fmt.Errorf("schema registry directory create error: %v", err)
+	}
+	err = os.WriteFile(path, b, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("schema registry file write error: %v", err)
+	}
+	return id, nil
+}
+
+// avroBackwardCompatible checks that record schema reader can read data written
+// with record schema writer, BACKWARD compatibility: fields added by reader
+// need a default and fields in both must resolve per the Avro specification.
+func avroBackwardCompatible(writer, reader string) error {
+	type record struct {
+		Fields []struct {
+			Name    string          `json:"name"`
+			Type    any             `json:"type"`
+			Default json.RawMessage `json:"default"`
+		} `json:"fields"`
+	}
+	var w, r record
+	err := json.Unmarshal([]byte(writer), &w)
+	if err != nil {
+		return fmt.Errorf("writer schema parse error: %v", err)
+	}
+	err = json.Unmarshal([]byte(reader), &r)
+	if err != nil {
+		return fmt.Errorf("reader schema parse error: %v", err)
+	}
+	writerTypes := make(map[string]any)
+	for _, f := range w.Fields {
+		writerTypes[f.Name] = f.Type
+	}
+	var problems []string
+	for _, f := range r.Fields {
+		writerType, ok := writerTypes[f.Name]
+		if !ok {
+			if f.Default == nil {
+				problems = append(problems, fmt.Sprintf("field %v added without a default", f.Name))
+			}
+			continue
+		}
+		if !avroTypeResolves(writerType, f.Type) {
+			problems = append(problems, fmt.Sprintf("field %v type changed from %v to %v", f.Name, avroTypeString(writerType), avroTypeString(f.Type)))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// avroPromotions lists the primitive types each writer type can be read as.
+var avroPromotions = map[string][]string{
+	"int":    {"long", "float", "double"},
+	"long":   {"float", "double"},
+	"float":  {"double"},
+	"string": {"bytes"},
+	"bytes":  {"string"},
+}
+
+// avroTypeResolves reports whether data written as writer can be read as reader.
+func avroTypeResolves(writer, reader any) bool {
+	if branches, ok := writer.([]any); ok {
+		for _, branch := range branches {
+			if !avroTypeResolves(branch, reader) {
+				return false
+			}
+		}
+		return true
+	}
+	if branches, ok := reader.([]any); ok {
+		for _, branch := range branches {
+			if avroTypeResolves(writer, branch) {
+				return true
+			}
+		}
+		return false
+	}
+	if reflect.DeepEqual(writer, reader) {
+		return true
+	}
+	writerName, writerPrimitive := writer.(string)
+	readerName, readerPrimitive := reader.(string)
+	if !writerPrimitive || !readerPrimitive {
+		// logical and complex types must match exactly
+		return false
+	}
+	for _, promotion := range avroPromotions[writerName] {
+		if promotion == readerName {
+			return true
+		}
+	}
+	return false
+}
+
+func avroTypeString(t any) string {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Sprint(t)
+	}
+	return string(b)
+}
@@ -21,6 +21,7 @@ func seedNMSdb() error {
 		return fmt.Errorf("seed nmsdbopen error: %v", err)
 	}
 	defer nmsDB.Close()
+	var candidates []pgTable
 	for i := 1; i <= int(dsnCount); i++ {
 		var dsnEnum int64 = int64(i)
 		var nmsColumn string
@@ -39,24 +40,67 @@ func seedNMSdb() error {
 			log.Println("PG Connected")
 		}
 		var pgUnlogged []string
-		/*
-			// unlogged tables are just placeholders in postgres replicas, remove them from table list
-			if os.Getenv("PG_DB_IS_REPLICA_"+strconv.FormatInt(dsnEnum, 10)) == "true" {
-				pgUnlogged, err = getUnloggedTables(pgPool)
-				if err != nil {
-					return fmt.Errorf("seed getunloggedtables error: %v", err)
-				}
+		// unlogged tables are just placeholders in postgres replicas, remove them from table list
+		if os.Getenv("PG_DB_IS_REPLICA_"+strconv.FormatInt(dsnEnum, 10)) == "true" {
+			pgUnlogged, err = getUnloggedTables(pgPool)
+			if err != nil {
+				return fmt.Errorf("seed getunloggedtables error: %v", err)
 			}
-		*/
-		_, err = getTablesWithNMS(dbSchema, nmsColumn, dsnEnum, pgUnlogged, pgPool, nmsDB)
+		}
+		schemas, err := getSourceSchemas(dbSchema, pgPool)
 		if err != nil {
-			log.Printf("seed gettableswithnms error: %v\n", err)
+			return fmt.Errorf("seed getsourceschemas error: %v", err)
+		}
+		for _, schema := range schemas {
+			pgTables, err := getTablesWithNMS(schema, nmsColumn, dsnEnum, pgUnlogged, pgPool)
+			if err != nil {
+				log.Printf("seed gettableswithnms error: %v\n", err)
+			}
+			candidates = append(candidates, pgTables...)
 		}
 		pgPool.Close()
 	}
+	// sink names are checked before any table is seeded, a colliding table
+	// would otherwise be captured by the next cdc run
+	seeded, err := nmsTablesQuery(nmsDB, false)
+	if err != nil {
+		return fmt.Errorf("seed nmstablesquery error: %v", err)
+	}
+	err = checkSinkNameCollisions(seedCandidateTables(seeded, candidates))
+	if err != nil {
+		return fmt.Errorf("seed checksinknamecollisions error: %v", err)
+	}
+	for _, candidate := range candidates {
+		err = seedNMSTable(candidate, nmsDB)
+		if err != nil {
+			log.Printf("seednmstable() error: %v", err)
+		}
+	}
 	_, err = nmsTablesQuery(nmsDB, true)
 	if err != nil {
 		return fmt.Errorf("seedstatebackup error: %v", err)
 	}
 	return nil
 }
+
+// seedCandidateTables returns the tables of the state database once candidates
+// are seeded: seeded tables, updated by the candidates of the same name.
+func seedCandidateTables(seeded []table, candidates []pgTable) []table {
+	var tables []table
+	for _, c := range candidates {
+		tables = append(tables, table{DSNEnum: c.dsnEnum, Schema: c.schema, Name: c.name, NMSColumn: c.nmsColumn, TableSchema: c.tableSchema, PKeyColumns: c.pKeyColumns})
+	}
+	for _, t := range seeded {
+		reseeded := false
+		for _, c := range candidates {
+			if c.dsnEnum == t.DSNEnum && c.schema == t.Schema && c.name == t.Name {
+				reseeded = true
+				break
+			}
+		}
+		if !reseeded {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
@@ -28,6 +28,7 @@ func singletonServer(addr string) {
 	http.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
 		io.WriteString(w, strconv.Itoa(os.Getpid()))
 	})
+	http.HandleFunc("/metrics", metricsHandler)
 	err := http.ListenAndServe(addr, nil)
 	if err != nil {
 		pid, err := getSingletonPID(addr)
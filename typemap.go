@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/jackc/pgx/v5/pgxpool"
+	sugar "github.com/waclawthedev/go-sugaring"
+)
+
+// typeMapping overrides how the columns matching its source, schema, table,
+// column and type globs are captured and typed in sinks. Type matches the
+// column's udt_name, its domain name, or "enum" for enum columns. Domains are
+// otherwise mapped as their base type, enums as text.
+//   - PGType: the type sinks map the column from, ie. text
+//   - BQType: the BigQuery type of the column, ie. GEOGRAPHY
+//   - Expression: replaces the column in the table query, {column} standing for the quoted column
+type typeMapping struct {
+	DSN        int64  `json:"dsn"`
+	Schema     string `json:"schema"`
+	Table      string `json:"table"`
+	Column     string `json:"column"`
+	Type       string `json:"type"`
+	PGType     string `json:"pg_type"`
+	BQType     string `json:"bq_type"`
+	Expression string `json:"expression"`
+}
+
+// loadTypeMappings reads the mappings of the TYPE_MAPPINGS_FILE JSON array.
+func loadTypeMappings() ([]typeMapping, error) {
+	var mappings []typeMapping
+	mappingsFile := os.Getenv("TYPE_MAPPINGS_FILE")
+	if mappingsFile == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(mappingsFile)
+	if err != nil {
+		return nil, fmt.Errorf("type mappings file read error: %v", err)
+	}
+	err = json.Unmarshal(b, &mappings)
+	if err != nil {
+		return nil, fmt.Errorf("type mappings file parse error: %v", err)
+	}
+	for i, m := range mappings {
+		if m.PGType == "" && m.BQType == "" && m.Expression == "" {
+			return nil, fmt.Errorf("type mapping %+v: one of pg_type, bq_type or expression is required", m)
+		}
+		if m.Expression != "" && !strings.Contains(m.Expression, "{column}") {
+			return nil, fmt.Errorf("type mapping %+v: expression must reference {column}", m)
+		}
+		if m.BQType != "" {
+			fieldType, ok := bqTypeNames[strings.ToUpper(m.BQType)]
+			if !ok {
+				return nil, fmt.Errorf("type mapping %+v: unknown bq_type", m)
+			}
+			mappings[i].BQType = string(fieldType)
+		}
+	}
+	return mappings, nil
+}
+
+// bqTypeNames maps the type names accepted as bq_type to BigQuery field types.
+var bqTypeNames = map[string]bigquery.FieldType{
+	"STRING":     bigquery.StringFieldType,
+	"BYTES":      bigquery.BytesFieldType,
+	"INTEGER":    bigquery.IntegerFieldType,
+	"INT64":      bigquery.IntegerFieldType,
+	"FLOAT":      bigquery.FloatFieldType,
+	"FLOAT64":    bigquery.FloatFieldType,
+	"NUMERIC":    bigquery.NumericFieldType,
+	"BIGNUMERIC": bigquery.BigNumericFieldType,
+	"BOOLEAN":    bigquery.BooleanFieldType,
+	"BOOL":       bigquery.BooleanFieldType,
+	"TIMESTAMP":  bigquery.TimestampFieldType,
+	"DATE":       bigquery.DateFieldType,
+	"TIME":       bigquery.TimeFieldType,
+	"DATETIME":   bigquery.DateTimeFieldType,
+	"GEOGRAPHY":  bigquery.GeographyFieldType,
+	"JSON":       bigquery.JSONFieldType,
+	"INTERVAL":   bigquery.IntervalFieldType,
+}
+
+func (m typeMapping) matches(t table, column, udtName, domainName string, isEnum bool) bool {
+	if !(m.DSN == 0 || m.DSN == t.DSNEnum) || !globMatch(m.Schema, t.Schema) || !globMatch(m.Table, t.Name) || !globMatch(m.Column, column) {
+		return false
+	}
+	return m.Type == "" || globMatch(m.Type, udtName) || (domainName != "" && globMatch(m.Type, domainName)) || (isEnum && m.Type == "enum")
+}
+
+// columnTypeMapping returns the first mapping matching t's column, with
+// empty fields if the column's type isn't overridden. The nms and primary key
+// columns keep their type, the capture and dedupe depend on it.
+func columnTypeMapping(mappings []typeMapping, t table, column, udtName, domainName string, isEnum bool) typeMapping {
+	for _, m := range mappings {
+		if m.matches(t, column, udtName, domainName, isEnum) {
+			if column == t.NMSColumn || sugar.Contains(t.PKeyColumns, column) {
+				log.Printf("columnTypeMapping: ignoring type mapping for key column %v.%v.%v\n", t.Schema, t.Name, column)
+				return typeMapping{}
+			}
+			return m
+		}
+	}
+	return typeMapping{}
+}
+
+// staleTypeKeys reports whether the columns of a cached table_schema lack the
+// domain_name and is_enum keys type mappings match on, for tables seeded
+// before type mappings.
+func staleTypeKeys(tableSchema string) (bool, error) {
+	var schema struct {
+		Columns []map[string]any `json:"columns"`
+	}
+	err := json.Unmarshal([]byte(tableSchema), &schema)
+	if err != nil {
+		return false, fmt.Errorf("tableschema parsejson: %v", err)
+	}
+	for _, column := range schema.Columns {
+		if _, ok := column["is_enum"]; !ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// refreshTypeKeys sets the domain_name and is_enum keys of t's cached
+// table_schema from the source when they are missing and t has type mappings,
+// and saves it in nmstables. The rest of the cached schema is left as seeded.
+func refreshTypeKeys(t *table, pgPool *pgxpool.Pool, nmsDB *sql.DB) error {
+	userRules, err := tableRules(*t)
+	if err != nil {
+		return err
+	}
+	if len(userRules.mappings) == 0 || t.TableSchema == "" {
+		return nil
+	}
+	stale, err := staleTypeKeys(t.TableSchema)
+	if err != nil || !stale {
+		return err
+	}
+	pgColumns, err := getTableColumns(t.Schema, t.Name, pgPool)
+	if err != nil {
+		return fmt.Errorf("refreshtypekeys() %v", err)
+	}
+	var tableSchema map[string]any
+	err = json.Unmarshal([]byte(t.TableSchema), &tableSchema)
+	if err != nil {
+		return fmt.Errorf("refreshtypekeys() tableschema parsejson: %v", err)
+	}
+	columns, _ := tableSchema["columns"].([]any)
+	for _, c := range columns {
+		column, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		// columns dropped from the source since the seed keep no type keys
+		column["domain_name"], column["is_enum"] = nil, false
+		for _, pc := range pgColumns {
+			if pc.name == column["column_name"] {
+				column["domain_name"], column["is_enum"] = pc.domainName, pc.isEnum
+				if pc.domainName == "" {
+					column["domain_name"] = nil
+				}
+			}
+		}
+	}
+	b, err := json.Marshal(tableSchema)
+	if err != nil {
+		return fmt.Errorf("refreshtypekeys() marshal: %v", err)
+	}
+	_, err = nmsDB.Exec("UPDATE nmstables SET table_schema = ? WHERE id = ?", string(b), t.ID)
+	if err != nil {
+		return fmt.Errorf("refreshtypekeys() exec error: %v", err)
+	}
+	log.Printf("refreshTypeKeys: added domain and enum types to the cached schema of %v.%v.%v\n", t.DSNEnum, t.Schema, t.Name)
+	t.TableSchema = string(b)
+	return nil
+}
+
+// expression returns the select list expression capturing column ident.
+func (m typeMapping) expression(ident string) string {
+	return strings.ReplaceAll(m.Expression, "{column}", ident) + " AS " + ident
+}
+
+// apply sets the type of a cached table_schema column to the mapping's.
+func (m typeMapping) apply(column map[string]any) {
+	if m.PGType != "" {
+		column["udt_name"] = m.PGType
+		column["data_type"] = m.PGType
+		if strings.HasPrefix(m.PGType, "_") {
+			column["data_type"] = "ARRAY"
+		}
+		column["character_maximum_length"] = nil
+		column["numeric_precision"] = nil
+		column["numeric_scale"] = nil
+	}
+	if m.BQType != "" {
+		column["bq_type"] = m.BQType
+	}
+}
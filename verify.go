@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/spf13/cast"
+	"google.golang.org/api/iterator"
+)
+
+// verifyChecksum sums a window's rows: their count and the sums of the first
+// 32 bits of the MD5 of their primary key and of their full row, which don't
+// depend on row order.
+type verifyChecksum struct {
+	rows  int64
+	pkeys int64
+	full  int64
+}
+
+func (c verifyChecksum) minus(o verifyChecksum) verifyChecksum {
+	return verifyChecksum{rows: c.rows - o.rows, pkeys: c.pkeys - o.pkeys, full: c.full - o.full}
+}
+
+// verifyRange is a window whose rows differ between the source and the sink.
+type verifyRange struct {
+	from time.Time
+	to   time.Time
+	pg   verifyChecksum
+	sink verifyChecksum
+}
+
+// verifyColumn is the expression of a column's canonical text in PostgreSQL
+// and in BigQuery, which are equal for equal values.
+type verifyColumn struct {
+	name string
+	pg   string
+	bq   string
+}
+
+// canonicalColumn returns the canonical text expressions of a column of
+// BigQuery type fieldType, or false if its values can't be compared exactly:
+// floats, numerics, bytes, JSON, arrays and blank padded text are skipped.
+func canonicalColumn(c schemaColumn, fieldType bigquery.FieldType) (verifyColumn, bool) {
+	pgIdent := pgx.Identifier{c.Name}.Sanitize()
+	bqIdent := "`" + c.Name + "`"
+	if c.DataType == "ARRAY" || isArrayType(c.UDTName) {
+		return verifyColumn{}, false
+	}
+	switch fieldType {
+	case bigquery.IntegerFieldType, bigquery.BooleanFieldType:
+		return verifyColumn{c.Name, pgIdent + "::text", "CAST(" + bqIdent + " AS STRING)"}, true
+	case bigquery.StringFieldType:
+		if c.UDTName == "bpchar" {
+			return verifyColumn{}, false
+		}
+		return verifyColumn{c.Name, pgIdent + "::text", bqIdent}, true
+	case bigquery.DateFieldType:
+		return verifyColumn{c.Name, "to_char(" + pgIdent + ", 'YYYY-MM-DD')", "FORMAT_DATE('%Y-%m-%d', " + bqIdent + ")"}, true
+	case bigquery.TimestampFieldType:
+		// timestamp values are loaded as UTC, as their epoch is computed
+		return verifyColumn{c.Name, "(extract(epoch FROM " + pgIdent + ") * 1000000)::bigint::text", "CAST(UNIX_MICROS(" + bqIdent + ") AS STRING)"}, true
+	}
+	return verifyColumn{}, false
+}
+
+// canonicalKeyColumn returns the canonical text expressions of a primary key
+// column canonicalColumn skips, or false if it has none. Numerics drop their
+// trailing zeros (trim_scale needs PostgreSQL 13) as BigQuery's do, floats have
+// no text form both agree on.
+func canonicalKeyColumn(c schemaColumn, fieldType bigquery.FieldType) (verifyColumn, bool) {
+	if c.DataType == "ARRAY" || isArrayType(c.UDTName) {
+		return verifyColumn{}, false
+	}
+	switch fieldType {
+	case bigquery.NumericFieldType, bigquery.BigNumericFieldType:
+		return verifyColumn{c.Name, "trim_scale(" + pgx.Identifier{c.Name}.Sanitize() + ")::text", "CAST(`" + c.Name + "` AS STRING)"}, true
+	}
+	return verifyColumn{}, false
+}
+
+// checksumSource sums a window's rows in the source and in the sink.
+type checksumSource interface {
+	checksums(from, to time.Time) (verifyChecksum, verifyChecksum, error)
+}
+
+// verifier compares a table's rows in PostgreSQL and in its BigQuery _cdc
+// table, where the latest version of each primary key is compared.
+type verifier struct {
+	t        table
+	nmsType  string
+	pkeys    []verifyColumn
+	columns  []verifyColumn
+	fullRows bool
+	pgPool   *pgxpool.Pool
+	bqClient *bigquery.Client
+	cdcTable string
+}
+
+// newVerifier returns the verifier of t's rows, with the columns of its full
+// row hash if fullRows is set.
+func newVerifier(t table, fullRows bool, pgPool *pgxpool.Pool, bqClient *bigquery.Client) (*verifier, []string, error) {
+	v := verifier{t: t, nmsType: nmsColumnType(t), fullRows: fullRows, pgPool: pgPool, bqClient: bqClient}
+	if v.nmsType != "timestamp" && v.nmsType != "timestamptz" {
+		return nil, nil, fmt.Errorf("nms column %v type %q is not a timestamp", t.NMSColumn, v.nmsType)
+	}
+	if len(t.PKeyColumns) == 0 {
+		return nil, nil, fmt.Errorf("table %v.%v has no primary key", t.Schema, t.Name)
+	}
+	v.cdcTable = bqClient.Project() + "." + os.Getenv("BQ_DATASET_"+cast.ToString(t.DSNEnum)) + "." + sinkTableName(t)
+	tableSchema, err := sinkTableSchema(t)
+	if err != nil {
+		return nil, nil, err
+	}
+	columns, err := parseSchemaColumns(tableSchema)
+	if err != nil {
+		return nil, nil, err
+	}
+	userRules, err := tableRules(t)
+	if err != nil {
+		return nil, nil, err
+	}
+	rules, sanitizeRules := userRules.columns, userRules.sanitize
+	byName := make(map[string]schemaColumn)
+	var skipped []string
+	for _, c := range columns {
+		byName[c.Name] = c
+		if !fullRows {
+			continue
+		}
+		fieldType, _, _ := bqFieldType(c)
+		vc, ok := canonicalColumn(c, fieldType)
+		// masked, mapped and sanitized values differ from the source's
+		if !ok || columnAction(rules, t, c.Name).Action != "" || c.BQType != "" || columnSanitized(sanitizeRules, t, c) {
+			skipped = append(skipped, c.Name)
+			continue
+		}
+		v.columns = append(v.columns, vc)
+	}
+	for _, name := range t.PKeyColumns {
+		c, ok := byName[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("primary key column %v not found in the table schema", name)
+		}
+		fieldType, _, _ := bqFieldType(c)
+		vc, ok := canonicalColumn(c, fieldType)
+		if !ok {
+			vc, ok = canonicalKeyColumn(c, fieldType)
+		}
+		if !ok {
+			return nil, nil, fmt.Errorf("primary key column %v of type %v can't be compared between PostgreSQL and BigQuery", name, c.UDTName)
+		}
+		v.pkeys = append(v.pkeys, vc)
+	}
+	return &v, skipped, nil
+}
+
+// columnSanitized reports whether a sanitize rule applies to column c.
+func columnSanitized(rules []sanitizeRule, t table, c schemaColumn) bool {
+	for _, r := range rules {
+		if r.matches(t, pgColumn{name: c.Name, udtName: c.UDTName, domainName: c.DomainName, isEnum: c.IsEnum}) {
+			return true
+		}
+	}
+	return false
+}
+
+// pgHash returns the expression of the first 32 bits of the MD5 of columns'
+// canonical text, as a bigint.
+func pgHash(columns []verifyColumn) string {
+	if len(columns) == 0 {
+		return "0"
+	}
+	var parts []string
+	for _, c := range columns {
+		parts = append(parts, "coalesce("+c.pg+", '\\N')")
+	}
+	return "('x' || substr(md5(" + strings.Join(parts, " || '|' || ") + "), 1, 8))::bit(32)::bigint"
+}
+
+// bqHash is pgHash in BigQuery.
+func bqHash(columns []verifyColumn) string {
+	if len(columns) == 0 {
+		return "0"
+	}
+	var parts []string
+	for _, c := range columns {
+		parts = append(parts, "COALESCE("+c.bq+", '\\\\N')")
+	}
+	return "CAST(CONCAT('0x', SUBSTR(TO_HEX(MD5(" + strings.Join(parts, " || '|' || ") + ")), 1, 8)) AS INT64)"
+}
+
+// pgChecksum sums the source rows with nms > from AND nms <= to.
+func (v *verifier) pgChecksum(from, to time.Time) (verifyChecksum, error) {
+	var c verifyChecksum
+	nmsIdent := pgx.Identifier{v.t.NMSColumn}.Sanitize()
+	query := "SELECT count(*), coalesce(sum(pkh), 0)::bigint, coalesce(sum(rh), 0)::bigint FROM (SELECT " +
+		pgHash(v.pkeys) + " AS pkh, " + pgHash(v.columns) + " AS rh FROM " + pgx.Identifier{v.t.Schema, v.t.Name}.Sanitize() +
+		" WHERE " + nmsIdent + " > " + quoteLiteral(formatNMS(from, v.nmsType)) + " AND " + nmsIdent + " <= " + quoteLiteral(formatNMS(to, v.nmsType)) + ") s"
+	err := v.pgPool.QueryRow(context.Background(), query).Scan(&c.rows, &c.pkeys, &c.full)
+	if err != nil {
+		return c, fmt.Errorf("pg checksum query error: %v", err)
+	}
+	return c, nil
+}
+
+// bqTimestamp returns the BigQuery literal of a window bound, timestamp nms
+// values are loaded as UTC.
+func (v *verifier) bqTimestamp(t time.Time) string {
+	if v.nmsType == "timestamptz" {
+		return "TIMESTAMP " + quoteLiteral(formatNMS(t, v.nmsType))
+	}
+	return "TIMESTAMP " + quoteLiteral(formatNMS(t, v.nmsType)+"+00:00")
+}
+
+// sinkChecksum sums the latest version of each primary key in the sink with
+// nms > from AND nms <= to. A row's nms only grows, so versions before from
+// are never the latest of a row in the window.
+func (v *verifier) sinkChecksum(from, to time.Time) (verifyChecksum, error) {
+	var c verifyChecksum
+	var pkeys []string
+	for _, k := range v.pkeys {
+		pkeys = append(pkeys, "`"+k.name+"`")
+	}
+	query := `SELECT COUNT(*), COALESCE(SUM(pkh), 0), COALESCE(SUM(rh), 0) FROM (
+	SELECT {pkeyHash} AS pkh, {rowHash} AS rh FROM (
+		SELECT *, ROW_NUMBER() OVER (PARTITION BY {pkey} ORDER BY snapshot_tm DESC) AS leftshove_rn
+		FROM ` + "`{cdcTable}`" + `
+		WHERE {nms} > {from}
+	) WHERE leftshove_rn = 1 AND {nms} <= {to}
+)`
+	query = strings.NewReplacer(
+		"{pkeyHash}", bqHash(v.pkeys),
+		"{rowHash}", bqHash(v.columns),
+		"{pkey}", strings.Join(pkeys, ", "),
+		"{cdcTable}", v.cdcTable,
+		"{nms}", "`"+v.t.NMSColumn+"`",
+		"{from}", v.bqTimestamp(from),
+		"{to}", v.bqTimestamp(to),
+	).Replace(query)
+	ctx := context.Background()
+	it, err := v.bqClient.Query(query).Read(ctx)
+	if err != nil {
+		return c, fmt.Errorf("bq checksum query error: %v", err)
+	}
+	var row []bigquery.Value
+	err = it.Next(&row)
+	if err != nil && !errors.Is(err, iterator.Done) {
+		return c, fmt.Errorf("bq checksum read error: %v", err)
+	}
+	if len(row) == 3 {
+		c.rows, c.pkeys, c.full = cast.ToInt64(row[0]), cast.ToInt64(row[1]), cast.ToInt64(row[2])
+	}
+	return c, nil
+}
+
+func (v *verifier) checksums(from, to time.Time) (verifyChecksum, verifyChecksum, error) {
+	pg, err := v.pgChecksum(from, to)
+	if err != nil {
+		return pg, verifyChecksum{}, err
+	}
+	sink, err := v.sinkChecksum(from, to)
+	return pg, sink, err
+}
+
+// bisect returns the windows no longer than resolution where the source and
+// sink checksums of from, to differ. Checksums are sums, so a window's second
+// half is the difference of the window and its first half.
+func bisect(src checksumSource, resolution time.Duration, from, to time.Time, pg, sink verifyChecksum) ([]verifyRange, error) {
+	if pg == sink {
+		return nil, nil
+	}
+	mid := from.Add(to.Sub(from) / 2).Truncate(time.Microsecond)
+	if to.Sub(from) <= resolution || !mid.After(from) {
+		return []verifyRange{{from: from, to: to, pg: pg, sink: sink}}, nil
+	}
+	pgFirst, sinkFirst, err := src.checksums(from, mid)
+	if err != nil {
+		return nil, err
+	}
+	first, err := bisect(src, resolution, from, mid, pgFirst, sinkFirst)
+	if err != nil {
+		return nil, err
+	}
+	second, err := bisect(src, resolution, mid, to, pg.minus(pgFirst), sink.minus(sinkFirst))
+	if err != nil {
+		return nil, err
+	}
+	return append(first, second...), nil
+}
+
+// verifyCommand runs `verify`, comparing a table's rows in PostgreSQL and
+// BigQuery over a window of its nms column and reporting the windows that
+// differ, which can be queued to be captured again.
+func verifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	tableName := fs.String("table", "", "table to verify, [schema.]name")
+	dsn := fs.Int64("dsn", 0, "source of the table, if its name is ambiguous")
+	fromFlag := fs.String("from", "", "window start, exclusive (ie. '2024-01-01 00:00:00')")
+	toFlag := fs.String("to", "", "window end, inclusive (default: the table's nms)")
+	fullRows := fs.Bool("full", false, "also compare a hash of full rows")
+	resolution := fs.Duration("resolution", time.Hour, "shortest window reported by bisection")
+	requeue := fs.Bool("requeue", false, "queue the windows that differ to be captured again")
+	fs.Parse(args)
+	if *tableName == "" || *fromFlag == "" {
+		return fmt.Errorf("verify: -table and -from are required")
+	}
+	if os.Getenv("OUTPUT_TYPE") != "BQ" {
+		return fmt.Errorf("verify: only the BQ output can be verified")
+	}
+
+	nmsDB, err := nmsDBOpen()
+	if err != nil {
+		return fmt.Errorf("verify nmsdbopen error: %v", err)
+	}
+	defer nmsDB.Close()
+	tables, err := nmsTablesQuery(nmsDB, false)
+	if err != nil {
+		return fmt.Errorf("verify nmstablesquery error: %v", err)
+	}
+	t, err := findTable(tables, *tableName, *dsn)
+	if err != nil {
+		return fmt.Errorf("verify: %v", err)
+	}
+	t.rules, err = loadUserRules()
+	if err != nil {
+		return fmt.Errorf("verify: %v", err)
+	}
+	pgPool, err := getPGConnection(os.Getenv("PG_DB_URL_" + cast.ToString(t.DSNEnum)))
+	if err != nil {
+		return fmt.Errorf("pg connection failure: %v", err)
+	}
+	defer pgPool.Close()
+	err = refreshTypeKeys(&t, pgPool, nmsDB)
+	if err != nil {
+		return fmt.Errorf("verify: %v", err)
+	}
+	clock, err := getSourceClock(pgPool)
+	if err != nil {
+		return fmt.Errorf("verify getsourceclock error: %v", err)
+	}
+	ctx := context.Background()
+	bqClient, err := bigquery.NewClient(ctx, os.Getenv("BQ_PROJECT"))
+	if err != nil {
+		return fmt.Errorf("bigquery.newclient() error: %v", err)
+	}
+	defer bqClient.Close()
+
+	v, skipped, err := newVerifier(t, *fullRows, pgPool, bqClient)
+	if err != nil {
+		return fmt.Errorf("verify: %v", err)
+	}
+	from, err := cast.ToTimeInDefaultLocationE(*fromFlag, clock.location)
+	if err != nil {
+		return fmt.Errorf("verify: invalid -from: %v", err)
+	}
+	// rows after the nms haven't been captured yet
+	to := clock.sourceTime(t.NMS, v.nmsType)
+	if *toFlag != "" {
+		to, err = cast.ToTimeInDefaultLocationE(*toFlag, clock.location)
+		if err != nil {
+			return fmt.Errorf("verify: invalid -to: %v", err)
+		}
+	}
+	if !to.After(from) {
+		return fmt.Errorf("verify: window end %v is not after its start %v", to, from)
+	}
+	if len(skipped) > 0 {
+		fmt.Printf("full row hash skips columns: %v\n", strings.Join(skipped, ", "))
+	}
+
+	pg, sink, err := v.checksums(from, to)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v.%v.%v (%v, %v]: pg rows %v, sink rows %v\n", t.DSNEnum, t.Schema, t.Name, formatNMS(from, v.nmsType), formatNMS(to, v.nmsType), pg.rows, sink.rows)
+	mismatches, err := bisect(v, *resolution, from, to, pg, sink)
+	if err != nil {
+		return err
+	}
+	for _, m := range mismatches {
+		var differ []string
+		if m.pg.rows != m.sink.rows {
+			differ = append(differ, fmt.Sprintf("rows %v != %v", m.pg.rows, m.sink.rows))
+		}
+		if m.pg.pkeys != m.sink.pkeys {
+			differ = append(differ, "primary keys")
+		}
+		if m.pg.full != m.sink.full {
+			differ = append(differ, "row values")
+		}
+		fmt.Printf("mismatch (%v, %v]: %v\n", formatNMS(m.from, v.nmsType), formatNMS(m.to, v.nmsType), strings.Join(differ, ", "))
+		if *requeue {
+			err = queueRecapture(nmsDB, t, m.from, m.to, "verify")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(mismatches) > 0 {
+		if *requeue {
+			fmt.Printf("%v windows queued to be captured again\n", len(mismatches))
+		}
+		return fmt.Errorf("verify: %v windows differ", len(mismatches))
+	}
+	fmt.Println("source and sink match")
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestCanonicalColumn(t *testing.T) {
+	tests := []struct {
+		name      string
+		column    schemaColumn
+		fieldType bigquery.FieldType
+		want      verifyColumn
+		ok        bool
+	}{
+		{"int8", schemaColumn{Name: "id", UDTName: "int8"}, bigquery.IntegerFieldType, verifyColumn{"id", `"id"::text`, "CAST(`id` AS STRING)"}, true},
+		{"bool", schemaColumn{Name: "ok", UDTName: "bool"}, bigquery.BooleanFieldType, verifyColumn{"ok", `"ok"::text`, "CAST(`ok` AS STRING)"}, true},
+		{"text", schemaColumn{Name: "name", UDTName: "text"}, bigquery.StringFieldType, verifyColumn{"name", `"name"::text`, "`name`"}, true},
+		{"uuid", schemaColumn{Name: "key", UDTName: "uuid"}, bigquery.StringFieldType, verifyColumn{"key", `"key"::text`, "`key`"}, true},
+		{"quoted name", schemaColumn{Name: `Na"me`, UDTName: "text"}, bigquery.StringFieldType, verifyColumn{`Na"me`, `"Na""me"::text`, "`Na\"me`"}, true},
+		{"date", schemaColumn{Name: "day", UDTName: "date"}, bigquery.DateFieldType, verifyColumn{"day", `to_char("day", 'YYYY-MM-DD')`, "FORMAT_DATE('%Y-%m-%d', `day`)"}, true},
+		{"timestamptz", schemaColumn{Name: "at", UDTName: "timestamptz"}, bigquery.TimestampFieldType, verifyColumn{"at", `(extract(epoch FROM "at") * 1000000)::bigint::text`, "CAST(UNIX_MICROS(`at`) AS STRING)"}, true},
+		{"bpchar", schemaColumn{Name: "code", UDTName: "bpchar"}, bigquery.StringFieldType, verifyColumn{}, false},
+		{"float8", schemaColumn{Name: "f", UDTName: "float8"}, bigquery.FloatFieldType, verifyColumn{}, false},
+		{"numeric", schemaColumn{Name: "n", UDTName: "numeric"}, bigquery.NumericFieldType, verifyColumn{}, false},
+		{"bytea", schemaColumn{Name: "b", UDTName: "bytea"}, bigquery.BytesFieldType, verifyColumn{}, false},
+		{"jsonb", schemaColumn{Name: "j", UDTName: "jsonb"}, bigquery.JSONFieldType, verifyColumn{}, false},
+		{"int4 array", schemaColumn{Name: "ids", UDTName: "_int4", DataType: "ARRAY"}, bigquery.IntegerFieldType, verifyColumn{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := canonicalColumn(tt.column, tt.fieldType)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("canonicalColumn(%+v, %v) = %+v, %v, want %+v, %v", tt.column, tt.fieldType, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCanonicalKeyColumn(t *testing.T) {
+	tests := []struct {
+		name      string
+		column    schemaColumn
+		fieldType bigquery.FieldType
+		want      verifyColumn
+		ok        bool
+	}{
+		{"numeric", schemaColumn{Name: "n", UDTName: "numeric"}, bigquery.NumericFieldType, verifyColumn{"n", `trim_scale("n")::text`, "CAST(`n` AS STRING)"}, true},
+		{"bignumeric", schemaColumn{Name: "n", UDTName: "numeric"}, bigquery.BigNumericFieldType, verifyColumn{"n", `trim_scale("n")::text`, "CAST(`n` AS STRING)"}, true},
+		{"float8", schemaColumn{Name: "f", UDTName: "float8"}, bigquery.FloatFieldType, verifyColumn{}, false},
+		{"numeric array", schemaColumn{Name: "n", UDTName: "_numeric", DataType: "ARRAY"}, bigquery.BigNumericFieldType, verifyColumn{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := canonicalKeyColumn(tt.column, tt.fieldType)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("canonicalKeyColumn(%+v, %v) = %+v, %v, want %+v, %v", tt.column, tt.fieldType, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+// fakeRow is a row of fakeChecksums at nms at, with its checksum in the
+// source and in the sink. A zero checksum is a missing row.
+type fakeRow struct {
+	at   time.Time
+	pg   verifyChecksum
+	sink verifyChecksum
+}
+
+// fakeChecksums sums rows with nms > from AND nms <= to, as the source and
+// sink checksum queries do.
+type fakeChecksums struct {
+	rows []fakeRow
+}
+
+func (f *fakeChecksums) checksums(from, to time.Time) (verifyChecksum, verifyChecksum, error) {
+	var pg, sink verifyChecksum
+	for _, r := range f.rows {
+		if r.at.After(from) && !r.at.After(to) {
+			pg = verifyChecksum{pg.rows + r.pg.rows, pg.pkeys + r.pg.pkeys, pg.full + r.pg.full}
+			sink = verifyChecksum{sink.rows + r.sink.rows, sink.pkeys + r.sink.pkeys, sink.full + r.sink.full}
+		}
+	}
+	return pg, sink, nil
+}
+
+func TestBisect(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(8 * time.Hour)
+	at := func(d time.Duration) time.Time { return from.Add(d) }
+	row := verifyChecksum{rows: 1, pkeys: 11, full: 101}
+	changed := verifyChecksum{rows: 1, pkeys: 11, full: 202}
+	tests := []struct {
+		name       string
+		rows       []fakeRow
+		resolution time.Duration
+		want       [][2]time.Time
+	}{
+		{"match", []fakeRow{{at(time.Hour), row, row}, {at(5 * time.Hour), row, row}}, time.Hour, nil},
+		{"missing row", []fakeRow{{at(time.Hour), row, row}, {at(150 * time.Minute), row, verifyChecksum{}}}, time.Hour, [][2]time.Time{{at(2 * time.Hour), at(3 * time.Hour)}}},
+		{"changed row", []fakeRow{{at(7*time.Hour + 30*time.Minute), row, changed}}, time.Hour, [][2]time.Time{{at(7 * time.Hour), at(8 * time.Hour)}}},
+		{"extra sink row", []fakeRow{{at(30 * time.Minute), verifyChecksum{}, row}}, 2 * time.Hour, [][2]time.Time{{from, at(2 * time.Hour)}}},
+		{"two windows", []fakeRow{{at(90 * time.Minute), row, verifyChecksum{}}, {at(6*time.Hour + 30*time.Minute), row, changed}}, time.Hour, [][2]time.Time{{at(time.Hour), at(2 * time.Hour)}, {at(6 * time.Hour), at(7 * time.Hour)}}},
+		{"window end is inclusive", []fakeRow{{at(4 * time.Hour), row, verifyChecksum{}}}, time.Hour, [][2]time.Time{{at(3 * time.Hour), at(4 * time.Hour)}}},
+		{"resolution above the window", []fakeRow{{at(time.Hour), row, verifyChecksum{}}}, 24 * time.Hour, [][2]time.Time{{from, to}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &fakeChecksums{rows: tt.rows}
+			pg, sink, _ := src.checksums(from, to)
+			got, err := bisect(src, tt.resolution, from, to, pg, sink)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var windows [][2]time.Time
+			for _, r := range got {
+				windows = append(windows, [2]time.Time{r.from, r.to})
+				wantPG, wantSink, _ := (&fakeChecksums{rows: tt.rows}).checksums(r.from, r.to)
+				if r.pg != wantPG || r.sink != wantSink {
+					t.Errorf("window (%v, %v] checksums = %+v, %+v, want %+v, %+v", r.from, r.to, r.pg, r.sink, wantPG, wantSink)
+				}
+			}
+			if !reflect.DeepEqual(windows, tt.want) {
+				t.Errorf("bisect() windows = %v, want %v", windows, tt.want)
+			}
+		})
+	}
+}